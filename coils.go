@@ -0,0 +1,97 @@
+package mbserver
+
+// setBits stores the values of coils or discrete inputs, which are stored one
+// per byte, 1 for on and 0 for off.
+func setBits(bits []byte, start uint16, values []bool) {
+	for i, on := range values {
+		var value byte
+		if on {
+			value = 1
+		}
+		bits[int(start)+i] = value
+	}
+}
+
+// getBits returns the values of coils or discrete inputs.
+func getBits(bits []byte, start uint16, count int) []bool {
+	values := make([]bool, count)
+	for i := range values {
+		values[i] = bits[int(start)+i] != 0
+	}
+	return values
+}
+
+// SetCoil sets the coil at address on or off.
+func (s *Server) SetCoil(address uint16, on bool) error {
+	return s.SetCoils(address, []bool{on})
+}
+
+// GetCoil reports whether the coil at address is on.
+func (s *Server) GetCoil(address uint16) (bool, error) {
+	values, err := s.GetCoils(address, 1)
+	if err != nil {
+		return false, err
+	}
+	return values[0], nil
+}
+
+// SetCoils sets the coils starting at address on or off.
+func (s *Server) SetCoils(start uint16, values []bool) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := checkRange("coils", len(s.Coils), start, len(values)); err != nil {
+		return err
+	}
+	setBits(s.Coils, start, values)
+	return nil
+}
+
+// GetCoils returns whether each of the count coils starting at address is on.
+func (s *Server) GetCoils(start, count uint16) ([]bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if err := checkRange("coils", len(s.Coils), start, int(count)); err != nil {
+		return nil, err
+	}
+	return getBits(s.Coils, start, int(count)), nil
+}
+
+// SetDiscreteInput sets the discrete input at address on or off.
+func (s *Server) SetDiscreteInput(address uint16, on bool) error {
+	return s.SetDiscreteInputs(address, []bool{on})
+}
+
+// GetDiscreteInput reports whether the discrete input at address is on.
+func (s *Server) GetDiscreteInput(address uint16) (bool, error) {
+	values, err := s.GetDiscreteInputs(address, 1)
+	if err != nil {
+		return false, err
+	}
+	return values[0], nil
+}
+
+// SetDiscreteInputs sets the discrete inputs starting at address on or off.
+func (s *Server) SetDiscreteInputs(start uint16, values []bool) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := checkRange("discrete inputs", len(s.DiscreteInputs), start, len(values)); err != nil {
+		return err
+	}
+	setBits(s.DiscreteInputs, start, values)
+	return nil
+}
+
+// GetDiscreteInputs returns whether each of the count discrete inputs
+// starting at address is on.
+func (s *Server) GetDiscreteInputs(start, count uint16) ([]bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if err := checkRange("discrete inputs", len(s.DiscreteInputs), start, int(count)); err != nil {
+		return nil, err
+	}
+	return getBits(s.DiscreteInputs, start, int(count)), nil
+}
@@ -0,0 +1,70 @@
+package mbserver
+
+import "testing"
+
+func TestCoils(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.AllocateMemory(10, 10, 1, 1)
+
+	if err := s.SetCoils(7, []bool{true, false, true}); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if err := s.SetCoil(0, true); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+
+	// Read the coils back with the Modbus function.
+	var frame TCPFrame
+	frame.Device = 255
+	frame.Function = 1
+	SetDataWithRegisterAndNumber(&frame, 0, 10)
+	var req Request
+	req.frame = &frame
+	expect := []byte{2, 0x81, 0x02}
+	if got := s.handle(&req).GetData(); !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	if on, err := s.GetCoil(9); err != nil || !on {
+		t.Errorf("expected true, got %v, %v", on, err)
+	}
+	values, err := s.GetCoils(6, 3)
+	if err != nil || values[0] || !values[1] || values[2] {
+		t.Errorf("expected [false true false], got %v, %v", values, err)
+	}
+
+	// Out of range.
+	if err := s.SetCoils(8, []bool{true, true, true}); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+	if s.Coils[8] != 0 {
+		t.Errorf("expected 0, got %v", s.Coils[8])
+	}
+	if _, err := s.GetCoil(10); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+	if _, err := s.GetCoils(6, 65535); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+}
+
+func TestDiscreteInputs(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.AllocateMemory(10, 10, 1, 1)
+
+	if err := s.SetDiscreteInput(9, true); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if s.DiscreteInputs[9] != 1 {
+		t.Errorf("expected 1, got %v", s.DiscreteInputs[9])
+	}
+	if on, err := s.GetDiscreteInput(9); err != nil || !on {
+		t.Errorf("expected true, got %v, %v", on, err)
+	}
+	if _, err := s.GetDiscreteInputs(5, 6); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+	if _, err := s.GetDiscreteInputs(1, 65535); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package mbserver
+
+// maxCommEvents is the number of events returned by the Get Comm Event Log
+// function.
+const maxCommEvents = 64
+
+// Comm event bytes, as defined for the Get Comm Event Log function.
+const (
+	receiveEvent               = 0x80
+	receiveCommunicationError  = 0x02
+	receiveBroadcast           = 0x40
+	sendEvent                  = 0x40
+	sendReadException          = 0x01
+	sendServerAbortException   = 0x02
+	sendServerBusyException    = 0x04
+	sendServerProgramException = 0x08
+)
+
+// commEventLog holds the most recent comm events.
+type commEventLog struct {
+	events [maxCommEvents]byte
+	next   int
+	len    int
+}
+
+// add adds an event, replacing the oldest event when the log is full.
+func (l *commEventLog) add(event byte) {
+	l.events[l.next] = event
+	l.next = (l.next + 1) % maxCommEvents
+	if l.len < maxCommEvents {
+		l.len++
+	}
+}
+
+// bytes returns the events, the most recent first.
+func (l *commEventLog) bytes() []byte {
+	events := make([]byte, l.len)
+	for i := range events {
+		events[i] = l.events[(l.next-1-i+maxCommEvents)%maxCommEvents]
+	}
+	return events
+}
+
+// logCommEvent adds an event to the server's comm event log.
+func (s *Server) logCommEvent(event byte) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	s.commEvents.add(event)
+}
+
+// sendCommEvent returns the event logged for a response with the exception.
+func sendCommEvent(exception *Exception) byte {
+	event := byte(sendEvent)
+	if !isException(exception) {
+		return event
+	}
+
+	switch *exception {
+	case IllegalFunction, IllegalDataAddress, IllegalDataValue:
+		event |= sendReadException
+	case SlaveDeviceFailure:
+		event |= sendServerAbortException
+	case AcknowledgeSlave, SlaveDeviceBusy:
+		event |= sendServerBusyException
+	case NegativeAcknowledge:
+		event |= sendServerProgramException
+	}
+	return event
+}
@@ -0,0 +1,86 @@
+package mbserver
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// contextKey is the type of the request metadata keys, preventing collisions
+// with context keys defined in other packages.
+type contextKey int
+
+const (
+	remoteAddrKey contextKey = iota
+	userKey
+	roleKey
+	responseWriterKey
+	connKey
+	remoteNetAddrKey
+	tlsStateKey
+)
+
+// withRemoteAddr adds the peer address and its host to the context. The
+// host of an IPv6 address has no brackets and keeps its zone.
+func withRemoteAddr(ctx context.Context, addr net.Addr) context.Context {
+	ctx = context.WithValue(ctx, remoteNetAddrKey, addr)
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		ctx = context.WithValue(ctx, remoteAddrKey, host)
+	}
+	return ctx
+}
+
+// withConn adds the connection and the host of its peer address to the
+// context.
+func withConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(withRemoteAddr(ctx, conn.RemoteAddr()), connKey, conn)
+}
+
+// ConnFromContext returns the TCP/IP connection the request was received on,
+// a *tls.Conn for TLS listeners, e.g. to inspect its TLS connection state or
+// set socket options. Requests received over UDP or a serial line have none.
+func ConnFromContext(ctx context.Context) (net.Conn, bool) {
+	conn, ok := ctx.Value(connKey).(net.Conn)
+	return conn, ok
+}
+
+// RemoteAddrFromContext returns the host of the client that sent the request.
+func RemoteAddrFromContext(ctx context.Context) (string, bool) {
+	host, ok := ctx.Value(remoteAddrKey).(string)
+	return host, ok
+}
+
+// RemoteNetAddrFromContext returns the address of the client that sent the
+// request, including its port and, for IPv6, its zone.
+func RemoteNetAddrFromContext(ctx context.Context) (net.Addr, bool) {
+	addr, ok := ctx.Value(remoteNetAddrKey).(net.Addr)
+	return addr, ok
+}
+
+// UserFromContext returns the common name of the TLS client certificate
+// carrying a role.
+func UserFromContext(ctx context.Context) (string, bool) {
+	user, ok := ctx.Value(userKey).(string)
+	return user, ok
+}
+
+// RoleFromContext returns the role in the TLS client certificate.
+func RoleFromContext(ctx context.Context) (string, bool) {
+	role, ok := ctx.Value(roleKey).(string)
+	return role, ok
+}
+
+// TLSStateFromContext returns the state of the TLS connection the request was
+// received on, including the negotiated TLS version and cipher suite.
+// Requests received without TLS have none.
+func TLSStateFromContext(ctx context.Context) (*tls.ConnectionState, bool) {
+	state, ok := ctx.Value(tlsStateKey).(*tls.ConnectionState)
+	return state, ok
+}
+
+// ResponseWriterFromContext returns the writer a ContextFunctionHandler
+// returning Deferred uses to write its response.
+func ResponseWriterFromContext(ctx context.Context) (ResponseWriter, bool) {
+	w, ok := ctx.Value(responseWriterKey).(ResponseWriter)
+	return w, ok
+}
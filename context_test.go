@@ -0,0 +1,135 @@
+package mbserver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRemoteAddrFromContext(t *testing.T) {
+	addrs := make(chan string, 1)
+	conns := make(chan net.Conn, 1)
+
+	s := NewServerWithDefaults()
+	s.RegisterContextFunctionHandler(100, func(ctx context.Context, frame Framer) ([]byte, *Exception) {
+		addr, _ := RemoteAddrFromContext(ctx)
+		addrs <- addr
+		conn, _ := ConnFromContext(ctx)
+		conns <- conn
+		return []byte{}, &Success
+	})
+	err := s.ListenTCP("127.0.0.1:3339")
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:3339")
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{0, 1, 0, 0, 0, 3, 255, 100, 0})
+
+	select {
+	case addr := <-addrs:
+		if addr != "127.0.0.1" {
+			t.Errorf("expected %v, got %v", "127.0.0.1", addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for request")
+	}
+
+	// The handler gets the server's end of the connection.
+	if serverConn := <-conns; serverConn == nil || serverConn.RemoteAddr().String() != conn.LocalAddr().String() {
+		t.Errorf("expected a connection from %v, got %v", conn.LocalAddr(), serverConn)
+	}
+	if _, ok := ConnFromContext(context.Background()); ok {
+		t.Errorf("expected no connection")
+	}
+}
+
+func TestRemoteAddrIPv6(t *testing.T) {
+	for _, test := range []struct {
+		addr   net.Addr
+		expect string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 502}, "192.0.2.1"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 502}, "2001:db8::1"},
+		{&net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 502, Zone: "eth0"}, "fe80::1%eth0"},
+	} {
+		ctx := withRemoteAddr(context.Background(), test.addr)
+		if host, _ := RemoteAddrFromContext(ctx); host != test.expect {
+			t.Errorf("expected %v, got %v", test.expect, host)
+		}
+		if addr, _ := RemoteNetAddrFromContext(ctx); addr != test.addr {
+			t.Errorf("expected %v, got %v", test.addr, addr)
+		}
+	}
+
+	// Addresses without a port keep the address but have no host.
+	addr := &net.UnixAddr{Name: "/run/modbus.sock", Net: "unix"}
+	ctx := withRemoteAddr(context.Background(), addr)
+	if _, ok := RemoteAddrFromContext(ctx); ok {
+		t.Errorf("expected no host")
+	}
+	if got, _ := RemoteNetAddrFromContext(ctx); got != addr {
+		t.Errorf("expected %v, got %v", addr, got)
+	}
+
+	// A client connected over IPv6.
+	hosts := make(chan string, 1)
+	s := NewServerWithDefaults()
+	s.RegisterContextFunctionHandler(100, func(ctx context.Context, frame Framer) ([]byte, *Exception) {
+		host, _ := RemoteAddrFromContext(ctx)
+		hosts <- host
+		return []byte{}, &Success
+	})
+	if err := s.ListenTCP("[::1]:3361"); err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", "[::1]:3361")
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{0, 1, 0, 0, 0, 3, 255, 100, 0})
+
+	select {
+	case host := <-hosts:
+		if host != "::1" {
+			t.Errorf("expected %v, got %v", "::1", host)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for request")
+	}
+}
+
+func TestUserAndRoleFromContext(t *testing.T) {
+	ctx := context.Background()
+
+	if _, ok := UserFromContext(ctx); ok {
+		t.Errorf("expected no user")
+	}
+	if _, ok := RoleFromContext(ctx); ok {
+		t.Errorf("expected no role")
+	}
+
+	// String keys from other packages do not collide.
+	ctx = context.WithValue(ctx, "Modbus-Role", "admin")
+	if _, ok := RoleFromContext(ctx); ok {
+		t.Errorf("expected no role")
+	}
+
+	ctx = context.WithValue(ctx, userKey, "operator")
+	ctx = context.WithValue(ctx, roleKey, "write")
+	if user, _ := UserFromContext(ctx); user != "operator" {
+		t.Errorf("expected %v, got %v", "operator", user)
+	}
+	if role, _ := RoleFromContext(ctx); role != "write" {
+		t.Errorf("expected %v, got %v", "write", role)
+	}
+}
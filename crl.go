@@ -0,0 +1,64 @@
+package mbserver
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// loadCRL reads a certificate revocation list signed by one of the CA
+// certificates, PEM or DER encoded, and returns a VerifyPeerCertificate
+// function rejecting the client certificates it revokes.
+func loadCRL(path string, caCertPEM []byte) (func([][]byte, [][]*x509.Certificate) error, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading CRL: %w", err)
+	}
+
+	crl, err := x509.ParseCRL(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing CRL: %w", err)
+	}
+	if crl.HasExpired(time.Now()) {
+		return nil, fmt.Errorf("CRL has expired")
+	}
+
+	issuer, err := crlIssuer(crl, caCertPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	revoked := make(map[string]bool)
+	for _, cert := range crl.TBSCertList.RevokedCertificates {
+		revoked[cert.SerialNumber.String()] = true
+	}
+
+	return func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				if revoked[cert.SerialNumber.String()] && bytes.Equal(cert.RawIssuer, issuer.RawSubject) {
+					return fmt.Errorf("certificate %q is revoked", cert.Subject.CommonName)
+				}
+			}
+		}
+		return nil
+	}, nil
+}
+
+// crlIssuer returns the CA certificate that signed the CRL.
+func crlIssuer(crl *pkix.CertificateList, caCertPEM []byte) (*x509.Certificate, error) {
+	for block, rest := pem.Decode(caCertPEM); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		if cert.CheckCRLSignature(crl) == nil {
+			return cert, nil
+		}
+	}
+	return nil, fmt.Errorf("CRL is not signed by the CA")
+}
@@ -26,41 +26,40 @@ var (
 	MemoryParityError Exception = 8
 	// GatewayPathUnavailable Specialized for Modbus gateways. Indicates a misconfigured gateway.
 	GatewayPathUnavailable Exception = 10
+	// GatewayTargetDeviceFailedToRespond Specialized for Modbus gateways. Sent when slave fails to respond.
+	GatewayTargetDeviceFailedToRespond Exception = 11
 	// GatewayTargetDeviceFailedtoRespond Specialized for Modbus gateways. Sent when slave fails to respond.
+	//
+	// Deprecated: Use GatewayTargetDeviceFailedToRespond.
 	GatewayTargetDeviceFailedtoRespond Exception = 11
 )
 
+// exceptionNames maps the standard exception codes to their names.
+var exceptionNames = map[Exception]string{
+	Success:                            "Success",
+	IllegalFunction:                    "IllegalFunction",
+	IllegalDataAddress:                 "IllegalDataAddress",
+	IllegalDataValue:                   "IllegalDataValue",
+	SlaveDeviceFailure:                 "SlaveDeviceFailure",
+	AcknowledgeSlave:                   "AcknowledgeSlave",
+	SlaveDeviceBusy:                    "SlaveDeviceBusy",
+	NegativeAcknowledge:                "NegativeAcknowledge",
+	MemoryParityError:                  "MemoryParityError",
+	GatewayPathUnavailable:             "GatewayPathUnavailable",
+	GatewayTargetDeviceFailedToRespond: "GatewayTargetDeviceFailedToRespond",
+}
+
+// Error returns the name and code of the exception, such as
+// "IllegalDataAddress (0x02)", so an *Exception can be used as an error.
 func (e Exception) Error() string {
-	return fmt.Sprintf("%d", e)
+	return fmt.Sprintf("%s (0x%02X)", e.String(), uint8(e))
 }
 
+// String returns the name of the exception, or "unknown" for codes outside
+// the standard set.
 func (e Exception) String() string {
-	var str string
-	switch e {
-	case Success:
-		str = fmt.Sprintf("Success")
-	case IllegalFunction:
-		str = fmt.Sprintf("IllegalFunction")
-	case IllegalDataAddress:
-		str = fmt.Sprintf("IllegalDataAddress")
-	case IllegalDataValue:
-		str = fmt.Sprintf("IllegalDataValue")
-	case SlaveDeviceFailure:
-		str = fmt.Sprintf("SlaveDeviceFailure")
-	case AcknowledgeSlave:
-		str = fmt.Sprintf("AcknowledgeSlave")
-	case SlaveDeviceBusy:
-		str = fmt.Sprintf("SlaveDeviceBusy")
-	case NegativeAcknowledge:
-		str = fmt.Sprintf("NegativeAcknowledge")
-	case MemoryParityError:
-		str = fmt.Sprintf("MemoryParityError")
-	case GatewayPathUnavailable:
-		str = fmt.Sprintf("GatewayPathUnavailable")
-	case GatewayTargetDeviceFailedtoRespond:
-		str = fmt.Sprintf("GatewayTargetDeviceFailedtoRespond")
-	default:
-		str = fmt.Sprintf("unknown")
+	if name, ok := exceptionNames[e]; ok {
+		return name
 	}
-	return str
+	return "unknown"
 }
@@ -0,0 +1,21 @@
+package mbserver
+
+import "testing"
+
+func TestExceptionError(t *testing.T) {
+	var err error = &IllegalDataAddress
+	expect := "IllegalDataAddress (0x02)"
+	if got := err.Error(); got != expect {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	expect = "GatewayTargetDeviceFailedToRespond (0x0B)"
+	if got := GatewayTargetDeviceFailedtoRespond.Error(); got != expect {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	expect = "unknown (0x0C)"
+	if got := Exception(12).Error(); got != expect {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
@@ -7,8 +7,10 @@ type Framer interface {
 	Bytes() []byte
 	Copy() Framer
 	GetUnitID() uint8
+	GetTransactionID() uint16
 	GetData() []byte
 	GetFunction() uint8
+	GetPDU() []byte
 	SetException(exception *Exception)
 	SetData(data []byte)
 }
@@ -22,6 +24,12 @@ func GetException(frame Framer) (exception Exception) {
 	return exception
 }
 
+// pdu returns the function code followed by the data, the protocol data unit
+// of a frame.
+func pdu(function uint8, data []byte) []byte {
+	return append([]byte{function}, data...)
+}
+
 func registerAddressAndNumber(frame Framer) (register int, numRegs int, endRegister int) {
 	data := frame.GetData()
 	register = int(binary.BigEndian.Uint16(data[0:2]))
@@ -0,0 +1,118 @@
+package mbserver
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// ASCIIFrame is the Modbus ASCII frame.
+type ASCIIFrame struct {
+	Address  uint8
+	Function uint8
+	Data     []byte
+	LRC      uint8
+}
+
+// NewASCIIFrame converts a packet, starting with ':' and ending with CRLF, to
+// a Modbus ASCII frame.
+func NewASCIIFrame(packet []byte) (*ASCIIFrame, error) {
+	pLen := len(packet)
+
+	// Check the packet envelope.
+	if pLen < 3 || packet[0] != ':' || string(packet[pLen-2:]) != "\r\n" {
+		return nil, fmt.Errorf("ASCII Frame error: packet must start with ':' and end with CRLF: %q", packet)
+	}
+
+	raw, err := hex.DecodeString(string(packet[1 : pLen-2]))
+	if err != nil {
+		return nil, fmt.Errorf("ASCII Frame error: invalid hex: %v", err)
+	}
+
+	// Check the packet length.
+	if len(raw) < 3 {
+		return nil, fmt.Errorf("ASCII Frame error: packet less than 3 bytes: %v", raw)
+	}
+
+	// Check the LRC.
+	rLen := len(raw)
+	lrcExpect := raw[rLen-1]
+	lrcCalc := lrcModbus(raw[0 : rLen-1])
+	if lrcCalc != lrcExpect {
+		return nil, fmt.Errorf("ASCII Frame error: LRC (expected 0x%x, got 0x%x)", lrcExpect, lrcCalc)
+	}
+
+	frame := &ASCIIFrame{
+		Address:  uint8(raw[0]),
+		Function: uint8(raw[1]),
+		Data:     raw[2 : rLen-1],
+	}
+
+	return frame, nil
+}
+
+// Copy the ASCIIFrame.
+func (frame *ASCIIFrame) Copy() Framer {
+	copy := *frame
+	return &copy
+}
+
+// Bytes returns the Modbus ASCII byte stream based on the ASCIIFrame fields.
+func (frame *ASCIIFrame) Bytes() []byte {
+	raw := make([]byte, 2)
+
+	raw[0] = frame.Address
+	raw[1] = frame.Function
+	raw = append(raw, frame.Data...)
+
+	// Add the LRC.
+	raw = append(raw, lrcModbus(raw))
+
+	return []byte(":" + strings.ToUpper(hex.EncodeToString(raw)) + "\r\n")
+}
+
+// GetUnitID returns the Modbus ASCII Slave ID.
+func (frame *ASCIIFrame) GetUnitID() uint8 {
+	return frame.Address
+}
+
+// GetTransactionID returns 0, ASCII frames do not have a transaction
+// identifier.
+func (frame *ASCIIFrame) GetTransactionID() uint16 {
+	return 0
+}
+
+// GetFunction returns the Modbus function code.
+func (frame *ASCIIFrame) GetFunction() uint8 {
+	return frame.Function
+}
+
+// GetData returns the ASCIIFrame Data byte field.
+func (frame *ASCIIFrame) GetData() []byte {
+	return frame.Data
+}
+
+// GetPDU returns the ASCIIFrame function code followed by the Data byte field.
+func (frame *ASCIIFrame) GetPDU() []byte {
+	return pdu(frame.Function, frame.Data)
+}
+
+// SetData sets the ASCIIFrame Data byte field.
+func (frame *ASCIIFrame) SetData(data []byte) {
+	frame.Data = data
+}
+
+// SetException sets the Modbus exception code in the frame.
+func (frame *ASCIIFrame) SetException(exception *Exception) {
+	frame.Function = frame.Function | 0x80
+	frame.Data = []byte{byte(*exception)}
+}
+
+// lrcModbus returns the two's complement of the sum of the data bytes.
+func lrcModbus(data []byte) uint8 {
+	var sum uint8
+	for _, v := range data {
+		sum += v
+	}
+	return -sum
+}
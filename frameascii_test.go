@@ -0,0 +1,76 @@
+package mbserver
+
+import "testing"
+
+func TestNewASCIIFrame(t *testing.T) {
+	frame, err := NewASCIIFrame([]byte(":010402FFFFFB\r\n"))
+	if !isEqual(nil, err) {
+		t.Fatalf("expected %v, got %v", nil, err)
+	}
+
+	got := frame.Address
+	expect := 1
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	got = frame.Function
+	expect = 4
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	if !isEqual([]byte{0x02, 0xFF, 0xFF}, frame.Data) {
+		t.Errorf("expected %v, got %v", []byte{0x02, 0xFF, 0xFF}, frame.Data)
+	}
+}
+
+func TestNewASCIIFrameLowerCase(t *testing.T) {
+	_, err := NewASCIIFrame([]byte(":010402fffffb\r\n"))
+	if !isEqual(nil, err) {
+		t.Fatalf("expected %v, got %v", nil, err)
+	}
+}
+
+func TestNewASCIIFrameShortPacket(t *testing.T) {
+	_, err := NewASCIIFrame([]byte(":01FF\r\n"))
+	if err == nil {
+		t.Fatalf("expected error not nil, got %v", err)
+	}
+}
+
+func TestNewASCIIFrameNoCRLF(t *testing.T) {
+	_, err := NewASCIIFrame([]byte(":010402FFFFFB"))
+	if err == nil {
+		t.Fatalf("expected error not nil, got %v", err)
+	}
+}
+
+func TestNewASCIIFrameBadHex(t *testing.T) {
+	_, err := NewASCIIFrame([]byte(":010402FFFXFB\r\n"))
+	if err == nil {
+		t.Fatalf("expected error not nil, got %v", err)
+	}
+}
+
+func TestNewASCIIFrameBadLRC(t *testing.T) {
+	// Bad LRC: 0xFC (should be 0xFB)
+	_, err := NewASCIIFrame([]byte(":010402FFFFFC\r\n"))
+	if err == nil {
+		t.Fatalf("expected error not nil, got %v", err)
+	}
+}
+
+func TestASCIIFrameBytes(t *testing.T) {
+	frame := &ASCIIFrame{
+		Address:  uint8(1),
+		Function: uint8(4),
+		Data:     []byte{0x02, 0xff, 0xff},
+	}
+
+	got := string(frame.Bytes())
+	expect := ":010402FFFFFB\r\n"
+	if !isEqual(expect, got) {
+		t.Errorf("expected %q, got %q", expect, got)
+	}
+}
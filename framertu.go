@@ -15,9 +15,10 @@ type RTUFrame struct {
 
 // NewRTUFrame converts a packet to a Modbus TCP frame.
 func NewRTUFrame(packet []byte) (*RTUFrame, error) {
-	// Check the that the packet length.
-	if len(packet) < 5 {
-		return nil, fmt.Errorf("RTU Frame error: packet less than 5 bytes: %v", packet)
+	// Check the that the packet length. Some functions, such as Read
+	// Exception Status, send no data after the function code.
+	if len(packet) < 4 {
+		return nil, fmt.Errorf("RTU Frame error: packet less than 4 bytes: %v", packet)
 	}
 
 	// Check the CRC.
@@ -67,6 +68,12 @@ func (frame *RTUFrame) GetUnitID() uint8 {
 	return frame.Address
 }
 
+// GetTransactionID returns 0, RTU frames do not have a transaction
+// identifier.
+func (frame *RTUFrame) GetTransactionID() uint16 {
+	return 0
+}
+
 // GetFunction returns the Modbus function code.
 func (frame *RTUFrame) GetFunction() uint8 {
 	return frame.Function
@@ -77,6 +84,11 @@ func (frame *RTUFrame) GetData() []byte {
 	return frame.Data
 }
 
+// GetPDU returns the RTUFrame function code followed by the Data byte field.
+func (frame *RTUFrame) GetPDU() []byte {
+	return pdu(frame.Function, frame.Data)
+}
+
 // SetData sets the RTUFrame Data byte field and updates the frame length
 // accordingly.
 func (frame *RTUFrame) SetData(data []byte) {
@@ -22,7 +22,7 @@ func TestNewRTUFrame(t *testing.T) {
 }
 
 func TestNewRTUFrameShortPacket(t *testing.T) {
-	_, err := NewRTUFrame([]byte{0x01, 0x04, 0xFF, 0xFF})
+	_, err := NewRTUFrame([]byte{0x01, 0x04, 0xFF})
 	if err == nil {
 		t.Fatalf("expected error not nil, got %v", err)
 	}
@@ -49,3 +49,16 @@ func TestRTUFrameBytes(t *testing.T) {
 		t.Errorf("expected %v, got %v", expect, got)
 	}
 }
+
+func TestRTUFrameGetPDU(t *testing.T) {
+	frame, err := NewRTUFrame([]byte{0x01, 0x04, 0x02, 0xFF, 0xFF, 0xB8, 0x80})
+	if !isEqual(nil, err) {
+		t.Fatalf("expected %v, got %v", nil, err)
+	}
+
+	expect := []byte{0x04, 0x02, 0xFF, 0xFF}
+	got := frame.GetPDU()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
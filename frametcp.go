@@ -17,9 +17,10 @@ type TCPFrame struct {
 
 // NewTCPFrame converts a packet to a Modbus TCP frame.
 func NewTCPFrame(packet []byte) (*TCPFrame, error) {
-	// Check if the packet is too short.
-	if len(packet) < 9 {
-		return nil, fmt.Errorf("TCP Frame error: packet less than 9 bytes")
+	// Check if the packet is too short. Some functions, such as Read
+	// Exception Status, send no data after the function code.
+	if len(packet) < 8 {
+		return nil, fmt.Errorf("TCP Frame error: packet less than 8 bytes")
 	}
 
 	frame := &TCPFrame{
@@ -64,6 +65,12 @@ func (frame *TCPFrame) GetUnitID() uint8 {
 	return frame.Device
 }
 
+// GetTransactionID returns the Modbus TCP transaction identifier, which
+// responses copy from their request.
+func (frame *TCPFrame) GetTransactionID() uint16 {
+	return frame.TransactionIdentifier
+}
+
 // GetFunction returns the Modbus function code.
 func (frame *TCPFrame) GetFunction() uint8 {
 	return frame.Function
@@ -74,6 +81,11 @@ func (frame *TCPFrame) GetData() []byte {
 	return frame.Data
 }
 
+// GetPDU returns the TCPFrame function code followed by the Data byte field.
+func (frame *TCPFrame) GetPDU() []byte {
+	return pdu(frame.Function, frame.Data)
+}
+
 // SetData sets the TCPFrame Data byte field and updates the frame length
 // accordingly.
 func (frame *TCPFrame) SetData(data []byte) {
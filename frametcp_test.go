@@ -0,0 +1,43 @@
+package mbserver
+
+import "testing"
+
+func TestTCPFrameTransactionID(t *testing.T) {
+	frame, err := NewTCPFrame([]byte{0x12, 0x34, 0, 0, 0, 6, 255, 3, 0, 1, 0, 1})
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if got := frame.GetTransactionID(); got != 0x1234 {
+		t.Errorf("expected %v, got %v", 0x1234, got)
+	}
+
+	// Responses, including exceptions, keep the request's transaction ID.
+	s := NewServerWithDefaults()
+	req := Request{frame: frame}
+	if got := s.handle(&req).GetTransactionID(); got != 0x1234 {
+		t.Errorf("expected %v, got %v", 0x1234, got)
+	}
+	frame.Function = 100
+	if got := s.handle(&req).GetTransactionID(); got != 0x1234 {
+		t.Errorf("expected %v, got %v", 0x1234, got)
+	}
+}
+
+func TestTCPFrameGetPDU(t *testing.T) {
+	frame, err := NewTCPFrame([]byte{0x12, 0x34, 0, 0, 0, 6, 255, 3, 0, 1, 0, 1})
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+
+	expect := []byte{3, 0, 1, 0, 1}
+	got := frame.GetPDU()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	// The PDU does not share memory with the frame.
+	got[1] = 0xFF
+	if frame.Data[0] != 0 {
+		t.Errorf("expected %v, got %v", 0, frame.Data[0])
+	}
+}
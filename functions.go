@@ -6,17 +6,21 @@ import (
 
 // ReadCoils function 1, reads coils from internal memory.
 func ReadCoils(s *Server, frame Framer) ([]byte, *Exception) {
-	register, numRegs, endRegister := registerAddressAndNumber(frame)
-	if endRegister > 65535 {
-		return []byte{}, &IllegalDataAddress
+	s.RLock()
+	defer s.RUnlock()
+
+	bank := s.bank(frame)
+	if exception := validateRead(frame, 2000, len(bank.Coils)); isException(exception) {
+		return []byte{}, exception
 	}
+	register, numRegs, endRegister := registerAddressAndNumber(frame)
 	dataSize := numRegs / 8
 	if (numRegs % 8) != 0 {
 		dataSize++
 	}
 	data := make([]byte, 1+dataSize)
 	data[0] = byte(dataSize)
-	for i, value := range s.Coils[register:endRegister] {
+	for i, value := range bank.Coils[register:endRegister] {
 		if value != 0 {
 			shift := uint(i) % 8
 			data[1+i/8] |= byte(1 << shift)
@@ -27,17 +31,21 @@ func ReadCoils(s *Server, frame Framer) ([]byte, *Exception) {
 
 // ReadDiscreteInputs function 2, reads discrete inputs from internal memory.
 func ReadDiscreteInputs(s *Server, frame Framer) ([]byte, *Exception) {
-	register, numRegs, endRegister := registerAddressAndNumber(frame)
-	if endRegister > 65535 {
-		return []byte{}, &IllegalDataAddress
+	s.RLock()
+	defer s.RUnlock()
+
+	bank := s.bank(frame)
+	if exception := validateRead(frame, 2000, len(bank.DiscreteInputs)); isException(exception) {
+		return []byte{}, exception
 	}
+	register, numRegs, endRegister := registerAddressAndNumber(frame)
 	dataSize := numRegs / 8
 	if (numRegs % 8) != 0 {
 		dataSize++
 	}
 	data := make([]byte, 1+dataSize)
 	data[0] = byte(dataSize)
-	for i, value := range s.DiscreteInputs[register:endRegister] {
+	for i, value := range bank.DiscreteInputs[register:endRegister] {
 		if value != 0 {
 			shift := uint(i) % 8
 			data[1+i/8] |= byte(1 << shift)
@@ -48,93 +56,445 @@ func ReadDiscreteInputs(s *Server, frame Framer) ([]byte, *Exception) {
 
 // ReadHoldingRegisters function 3, reads holding registers from internal memory.
 func ReadHoldingRegisters(s *Server, frame Framer) ([]byte, *Exception) {
-	register, numRegs, endRegister := registerAddressAndNumber(frame)
-	if endRegister > 65536 {
-		return []byte{}, &IllegalDataAddress
+	s.RLock()
+	defer s.RUnlock()
+
+	bank := s.bank(frame)
+	if exception := validateRead(frame, 125, len(bank.HoldingRegisters)); isException(exception) {
+		return []byte{}, exception
 	}
-	return append([]byte{byte(numRegs * 2)}, Uint16ToBytes(s.HoldingRegisters[register:endRegister])...), &Success
+	register, numRegs, endRegister := registerAddressAndNumber(frame)
+	return append([]byte{byte(numRegs * 2)}, Uint16ToBytes(bank.HoldingRegisters[register:endRegister])...), &Success
 }
 
 // ReadInputRegisters function 4, reads input registers from internal memory.
 func ReadInputRegisters(s *Server, frame Framer) ([]byte, *Exception) {
-	register, numRegs, endRegister := registerAddressAndNumber(frame)
-	if endRegister > 65536 {
-		return []byte{}, &IllegalDataAddress
+	s.RLock()
+	defer s.RUnlock()
+
+	bank := s.bank(frame)
+	if exception := validateRead(frame, 125, len(bank.InputRegisters)); isException(exception) {
+		return []byte{}, exception
 	}
-	return append([]byte{byte(numRegs * 2)}, Uint16ToBytes(s.InputRegisters[register:endRegister])...), &Success
+	register, numRegs, endRegister := registerAddressAndNumber(frame)
+	return append([]byte{byte(numRegs * 2)}, Uint16ToBytes(bank.InputRegisters[register:endRegister])...), &Success
 }
 
 // WriteSingleCoil function 5, write a coil to internal memory.
 func WriteSingleCoil(s *Server, frame Framer) ([]byte, *Exception) {
+	s.Lock()
+	bank := s.bank(frame)
+	if exception := validateWriteSingleCoil(bank, frame); isException(exception) {
+		s.Unlock()
+		return []byte{}, exception
+	}
 	register, value := registerAddressAndValue(frame)
-	// TODO Should we use 0 for off and 65,280 (FF00 in hexadecimal) for on?
-	if value != 0 {
+	if value == 0xFF00 {
 		value = 1
 	}
-	s.Coils[register] = byte(value)
+	bank.Coils[register] = byte(value)
+	s.Unlock()
+
+	s.notifyWrite(frame, register, []uint16{value})
 	return frame.GetData()[0:4], &Success
 }
 
 // WriteHoldingRegister function 6, write a holding register to internal memory.
 func WriteHoldingRegister(s *Server, frame Framer) ([]byte, *Exception) {
+	s.Lock()
+	bank := s.bank(frame)
+	if exception := validateWriteHoldingRegister(bank, frame); isException(exception) {
+		s.Unlock()
+		return []byte{}, exception
+	}
 	register, value := registerAddressAndValue(frame)
-	s.HoldingRegisters[register] = value
+	bank.HoldingRegisters[register] = value
+	s.Unlock()
+
+	s.notifyWrite(frame, register, []uint16{value})
 	return frame.GetData()[0:4], &Success
 }
 
+// ReadExceptionStatus function 7, reads the exception status byte.
+func ReadExceptionStatus(s *Server, frame Framer) ([]byte, *Exception) {
+	return []byte{s.ExceptionStatus()}, &Success
+}
+
+// Diagnostics function 8, runs a diagnostics sub-function.
+func Diagnostics(s *Server, frame Framer) ([]byte, *Exception) {
+	data := frame.GetData()
+	if len(data) < 2 {
+		return []byte{}, &IllegalDataValue
+	}
+
+	subFunction := binary.BigEndian.Uint16(data[0:2])
+
+	// Return Query Data echoes any amount of request data.
+	if subFunction == 0x00 {
+		return data, &Success
+	}
+
+	if len(data) != 4 {
+		return []byte{}, &IllegalDataValue
+	}
+
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	var value uint16
+	switch subFunction {
+	case 0x02:
+		value = s.diagnosticRegister
+	case 0x0A:
+		s.diagnosticRegister = 0
+		s.diagnostics = DiagnosticCounters{}
+		s.commEventCounter = 0
+		return data, &Success
+	case 0x0B:
+		value = s.diagnostics.BusMessage
+	case 0x0C:
+		value = s.diagnostics.BusCommunicationError
+	case 0x0D:
+		value = s.diagnostics.BusExceptionError
+	case 0x0E:
+		value = s.diagnostics.ServerMessage
+	case 0x0F:
+		value = s.diagnostics.ServerNoResponse
+	case 0x10:
+		value = s.diagnostics.ServerNAK
+	case 0x11:
+		value = s.diagnostics.ServerBusy
+	case 0x12:
+		value = s.diagnostics.BusCharacterOverrun
+	default:
+		// Unsupported sub-functions are treated as unsupported functions.
+		return []byte{}, &IllegalFunction
+	}
+
+	response := make([]byte, 4)
+	binary.BigEndian.PutUint16(response[0:2], subFunction)
+	binary.BigEndian.PutUint16(response[2:4], value)
+	return response, &Success
+}
+
+// GetCommEventCounter function 11, returns the status word and the number of
+// messages successfully handled. A busy server answers SlaveDeviceBusy
+// instead, so the status word is always zero.
+func GetCommEventCounter(s *Server, frame Framer) ([]byte, *Exception) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	response := make([]byte, 4)
+	binary.BigEndian.PutUint16(response[2:4], s.commEventCounter)
+	return response, &Success
+}
+
+// GetCommEventLog function 12, returns the status word, the event and message
+// counters and the most recent comm events. Like Get Comm Event Counter, the
+// status word is always zero.
+func GetCommEventLog(s *Server, frame Framer) ([]byte, *Exception) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	events := s.commEvents.bytes()
+	response := make([]byte, 7, 7+len(events))
+	response[0] = byte(6 + len(events))
+	binary.BigEndian.PutUint16(response[3:5], s.commEventCounter)
+	binary.BigEndian.PutUint16(response[5:7], s.diagnostics.BusMessage)
+	return append(response, events...), &Success
+}
+
 // WriteMultipleCoils function 15, writes holding registers to internal memory.
 func WriteMultipleCoils(s *Server, frame Framer) ([]byte, *Exception) {
-	register, numRegs, endRegister := registerAddressAndNumber(frame)
+	s.Lock()
+	bank := s.bank(frame)
+	if exception := validateWriteMultipleCoils(bank, frame); isException(exception) {
+		s.Unlock()
+		return []byte{}, exception
+	}
+	register, numRegs, _ := registerAddressAndNumber(frame)
 	valueBytes := frame.GetData()[5:]
 
-	if endRegister > 65536 {
-		return []byte{}, &IllegalDataAddress
+	// Stage the coils, then apply them all under the lock before notifying
+	// OnWrite and the subscribers.
+	values := make([]uint16, numRegs)
+	for i := range values {
+		values[i] = uint16(bitAtPosition(valueBytes[i/8], uint(i)%8))
 	}
-
-	// TODO This is not correct, bits and bytes do not always align
-	//if len(valueBytes)/2 != numRegs {
-	//	return []byte{}, &IllegalDataAddress
-	//}
-
-	bitCount := 0
-	for i, value := range valueBytes {
-		for bitPos := uint(0); bitPos < 8; bitPos++ {
-			s.Coils[register+(i*8)+int(bitPos)] = bitAtPosition(value, bitPos)
-			bitCount++
-			if bitCount >= numRegs {
-				break
-			}
-		}
-		if bitCount >= numRegs {
-			break
-		}
+	for i, value := range values {
+		bank.Coils[register+i] = byte(value)
 	}
+	s.Unlock()
+
+	s.notifyWrite(frame, register, values)
 
 	return frame.GetData()[0:4], &Success
 }
 
 // WriteHoldingRegisters function 16, writes holding registers to internal memory.
 func WriteHoldingRegisters(s *Server, frame Framer) ([]byte, *Exception) {
-	register, numRegs, _ := registerAddressAndNumber(frame)
-	valueBytes := frame.GetData()[5:]
-	var exception *Exception
-	var data []byte
-
-	if len(valueBytes)/2 != numRegs {
-		exception = &IllegalDataAddress
+	s.Lock()
+	// Validate the whole write before changing any register.
+	bank := s.bank(frame)
+	if exception := validateWriteHoldingRegisters(bank, frame); isException(exception) {
+		s.Unlock()
+		return []byte{}, exception
 	}
+	register, _, endRegister := registerAddressAndNumber(frame)
+	valueBytes := frame.GetData()[5:]
 
-	// Copy data to memroy
+	// Stage the registers, then apply them all under the lock before
+	// notifying OnWrite and the subscribers.
 	values := BytesToUint16(valueBytes)
-	valuesUpdated := copy(s.HoldingRegisters[register:], values)
-	if valuesUpdated == numRegs {
-		exception = &Success
-		data = frame.GetData()[0:4]
+	copy(bank.HoldingRegisters[register:endRegister], values)
+	s.Unlock()
+
+	s.notifyWrite(frame, register, values)
+
+	return frame.GetData()[0:4], &Success
+}
+
+// ReportServerID function 17, reports the server ID and run indicator status.
+func ReportServerID(s *Server, frame Framer) ([]byte, *Exception) {
+	data := make([]byte, 1, 2+len(s.ServerID))
+	data[0] = byte(len(s.ServerID) + 1)
+	data = append(data, s.ServerID...)
+	if s.RunIndicator() {
+		data = append(data, 0xFF)
 	} else {
-		exception = &IllegalDataAddress
+		data = append(data, 0x00)
+	}
+	return data, &Success
+}
+
+// ReadFileRecord function 20, reads groups of file records from internal
+// memory.
+func ReadFileRecord(s *Server, frame Framer) ([]byte, *Exception) {
+	s.RLock()
+	defer s.RUnlock()
+
+	data := frame.GetData()
+	if len(data) < 1 {
+		return []byte{}, &IllegalDataValue
+	}
+
+	byteCount := int(data[0])
+	if byteCount < 0x07 || byteCount > 0xF5 || byteCount%7 != 0 || byteCount != len(data)-1 {
+		return []byte{}, &IllegalDataValue
+	}
+
+	response := []byte{0}
+	for group := data[1:]; len(group) > 0; group = group[7:] {
+		referenceType := group[0]
+		file := binary.BigEndian.Uint16(group[1:3])
+		record := int(binary.BigEndian.Uint16(group[3:5]))
+		length := int(binary.BigEndian.Uint16(group[5:7]))
+
+		records, ok := s.FileRecords[file]
+		if referenceType != 6 || !ok || record > 0x270F || record+length > len(records) {
+			return []byte{}, &IllegalDataAddress
+		}
+
+		response = append(response, byte(1+length*2), referenceType)
+		response = append(response, Uint16ToBytes(records[record:record+length])...)
+		if len(response)-1 > 0xF5 {
+			return []byte{}, &IllegalDataValue
+		}
+	}
+	response[0] = byte(len(response) - 1)
+
+	return response, &Success
+}
+
+// WriteFileRecord function 21, writes groups of file records to internal
+// memory. Files and records that do not exist yet are allocated.
+func WriteFileRecord(s *Server, frame Framer) ([]byte, *Exception) {
+	s.Lock()
+	defer s.Unlock()
+
+	data := frame.GetData()
+	if len(data) < 1 {
+		return []byte{}, &IllegalDataValue
+	}
+
+	byteCount := int(data[0])
+	if byteCount < 0x09 || byteCount > 0xFB || byteCount != len(data)-1 {
+		return []byte{}, &IllegalDataValue
+	}
+
+	// Validate every group before writing any of them.
+	var groups [][]byte
+	for group := data[1:]; len(group) > 0; {
+		if len(group) < 7 {
+			return []byte{}, &IllegalDataValue
+		}
+
+		record := int(binary.BigEndian.Uint16(group[3:5]))
+		length := int(binary.BigEndian.Uint16(group[5:7]))
+		if len(group) < 7+length*2 {
+			return []byte{}, &IllegalDataValue
+		}
+		if group[0] != 6 || record > 0x270F {
+			return []byte{}, &IllegalDataAddress
+		}
+
+		groups = append(groups, group[:7+length*2])
+		group = group[7+length*2:]
+	}
+
+	if s.FileRecords == nil {
+		s.FileRecords = make(map[uint16][]uint16)
+	}
+
+	for _, group := range groups {
+		file := binary.BigEndian.Uint16(group[1:3])
+		record := int(binary.BigEndian.Uint16(group[3:5]))
+		values := BytesToUint16(group[7:])
+
+		records := s.FileRecords[file]
+		if end := record + len(values); end > len(records) {
+			records = append(records, make([]uint16, end-len(records))...)
+		}
+		copy(records[record:], values)
+		s.FileRecords[file] = records
+	}
+
+	return data, &Success
+}
+
+// MaskWriteRegister function 22, modifies a holding register in internal
+// memory using an AND mask and an OR mask.
+func MaskWriteRegister(s *Server, frame Framer) ([]byte, *Exception) {
+	s.Lock()
+	bank := s.bank(frame)
+	if exception := validateMaskWriteRegister(bank, frame); isException(exception) {
+		s.Unlock()
+		return []byte{}, exception
+	}
+	data := frame.GetData()
+	register := int(binary.BigEndian.Uint16(data[0:2]))
+	andMask := binary.BigEndian.Uint16(data[2:4])
+	orMask := binary.BigEndian.Uint16(data[4:6])
+
+	value := (bank.HoldingRegisters[register] & andMask) | (orMask &^ andMask)
+	bank.HoldingRegisters[register] = value
+	s.Unlock()
+
+	s.notifyWrite(frame, register, []uint16{value})
+
+	return data, &Success
+}
+
+// ReadWriteMultipleRegisters function 23, writes holding registers to internal
+// memory and then reads holding registers from internal memory.
+func ReadWriteMultipleRegisters(s *Server, frame Framer) ([]byte, *Exception) {
+	s.Lock()
+	bank := s.bank(frame)
+	if exception := validateReadWriteMultipleRegisters(bank, frame); isException(exception) {
+		s.Unlock()
+		return []byte{}, exception
+	}
+	data := frame.GetData()
+	readRegister, readNumRegs, _ := registerAddressAndNumber(frame)
+	writeRegister := int(binary.BigEndian.Uint16(data[4:6]))
+	valueBytes := data[9:]
+
+	// The write is performed before the read.
+	writeValues := BytesToUint16(valueBytes)
+	copy(bank.HoldingRegisters[writeRegister:], writeValues)
+	values := Uint16ToBytes(bank.HoldingRegisters[readRegister : readRegister+readNumRegs])
+	s.Unlock()
+
+	s.notifyWrite(frame, writeRegister, writeValues)
+	return append([]byte{byte(readNumRegs * 2)}, values...), &Success
+}
+
+// ReadFIFOQueue function 24, reads the FIFO queue at a pointer address from
+// internal memory. An address without a queue returns an empty queue.
+func ReadFIFOQueue(s *Server, frame Framer) ([]byte, *Exception) {
+	s.RLock()
+	defer s.RUnlock()
+
+	data := frame.GetData()
+	if len(data) != 2 {
+		return []byte{}, &IllegalDataValue
+	}
+
+	queue := s.fifoQueues[binary.BigEndian.Uint16(data[0:2])]
+	if len(queue) > 31 {
+		return []byte{}, &IllegalDataValue
+	}
+
+	response := make([]byte, 4, 4+len(queue)*2)
+	binary.BigEndian.PutUint16(response[0:2], uint16(2+len(queue)*2))
+	binary.BigEndian.PutUint16(response[2:4], uint16(len(queue)))
+	return append(response, Uint16ToBytes(queue)...), &Success
+}
+
+// ReadDeviceIdentification function 43 with MEI type 14, reads the device
+// identification objects. Basic, regular and extended stream access and
+// individual object access are supported.
+func ReadDeviceIdentification(s *Server, frame Framer) ([]byte, *Exception) {
+	data := frame.GetData()
+	if len(data) != 3 || data[0] != 0x0E {
+		return []byte{}, &IllegalDataValue
+	}
+
+	code, objectID := data[1], data[2]
+	objects := s.DeviceIdentification.objects()
+
+	conformity := byte(0x82)
+	if objects[len(objects)-1].id >= 0x80 {
+		conformity = 0x83
+	}
+
+	var last byte
+	switch code {
+	case 0x01:
+		last = 0x02
+	case 0x02:
+		last = 0x7F
+	case 0x03:
+		last = 0xFF
+	case 0x04:
+		for _, object := range objects {
+			if object.id == objectID {
+				response := []byte{0x0E, code, conformity, 0x00, 0x00, 1, object.id, byte(len(object.value))}
+				return append(response, object.value...), &Success
+			}
+		}
+		return []byte{}, &IllegalDataAddress
+	default:
+		return []byte{}, &IllegalDataValue
+	}
+
+	// Stream access restarts at the first object when the requested object
+	// is not part of the category.
+	var stream []deviceObject
+	start := 0
+	for _, object := range objects {
+		if object.id <= last {
+			if object.id == objectID {
+				start = len(stream)
+			}
+			stream = append(stream, object)
+		}
+	}
+
+	response := []byte{0x0E, code, conformity, 0x00, 0x00, 0}
+	for _, object := range stream[start:] {
+		// Objects that do not fit in the PDU are left for the next request.
+		if 1+len(response)+2+len(object.value) > 253 {
+			response[3] = 0xFF
+			response[4] = object.id
+			break
+		}
+		response = append(response, object.id, byte(len(object.value)))
+		response = append(response, object.value...)
+		response[5]++
 	}
 
-	return data, exception
+	return response, &Success
 }
 
 // BytesToUint16 converts a big endian array of bytes to an array of unit16s
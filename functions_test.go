@@ -1,6 +1,7 @@
 package mbserver
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"testing"
 )
@@ -16,7 +17,7 @@ func isEqual(a interface{}, b interface{}) bool {
 
 // Function 1
 func TestReadCoils(t *testing.T) {
-	s := NewServer()
+	s := NewServerWithDefaults()
 	// Set the coil values
 	s.Coils[10] = 1
 	s.Coils[11] = 1
@@ -50,7 +51,7 @@ func TestReadCoils(t *testing.T) {
 
 // Function 2
 func TestReadDiscreteInputs(t *testing.T) {
-	s := NewServer()
+	s := NewServerWithDefaults()
 	// Set the discrete input values
 	s.DiscreteInputs[0] = 1
 	s.DiscreteInputs[7] = 1
@@ -83,7 +84,7 @@ func TestReadDiscreteInputs(t *testing.T) {
 
 // Function 3
 func TestReadHoldingRegisters(t *testing.T) {
-	s := NewServer()
+	s := NewServerWithDefaults()
 	s.HoldingRegisters[100] = 1
 	s.HoldingRegisters[101] = 2
 	s.HoldingRegisters[102] = 65535
@@ -113,7 +114,7 @@ func TestReadHoldingRegisters(t *testing.T) {
 
 // Function 4
 func TestReadInputRegisters(t *testing.T) {
-	s := NewServer()
+	s := NewServerWithDefaults()
 	s.InputRegisters[200] = 1
 	s.InputRegisters[201] = 2
 	s.InputRegisters[202] = 65535
@@ -143,7 +144,7 @@ func TestReadInputRegisters(t *testing.T) {
 
 // Function 5
 func TestWriteSingleCoil(t *testing.T) {
-	s := NewServer()
+	s := NewServerWithDefaults()
 
 	var frame TCPFrame
 	frame.TransactionIdentifier = 1
@@ -151,7 +152,7 @@ func TestWriteSingleCoil(t *testing.T) {
 	frame.Length = 12
 	frame.Device = 255
 	frame.Function = 5
-	SetDataWithRegisterAndNumber(&frame, 65535, 1024)
+	SetDataWithRegisterAndNumber(&frame, 65535, 0xFF00)
 
 	var req Request
 	req.frame = &frame
@@ -166,11 +167,41 @@ func TestWriteSingleCoil(t *testing.T) {
 	if !isEqual(expect, got) {
 		t.Errorf("expected %v, got %v\n", expect, got)
 	}
+	if !isEqual(frame.Bytes(), response.Bytes()) {
+		t.Errorf("expected %v, got %v\n", frame.Bytes(), response.Bytes())
+	}
+
+	SetDataWithRegisterAndNumber(&frame, 65535, 0x0000)
+	response = s.handle(&req)
+	exception = GetException(response)
+	if exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+		t.FailNow()
+	}
+	expect = 0
+	got = s.Coils[65535]
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v\n", expect, got)
+	}
+	if !isEqual(frame.Bytes(), response.Bytes()) {
+		t.Errorf("expected %v, got %v\n", frame.Bytes(), response.Bytes())
+	}
+
+	// Values other than 0xFF00 and 0x0000 are rejected.
+	SetDataWithRegisterAndNumber(&frame, 65535, 0x1234)
+	response = s.handle(&req)
+	exception = GetException(response)
+	if exception != IllegalDataValue {
+		t.Errorf("expected IllegalDataValue, got %v", exception.String())
+	}
+	if s.Coils[65535] != 0 {
+		t.Errorf("expected 0, got %v\n", s.Coils[65535])
+	}
 }
 
 // Function 6
 func TestWriteHoldingRegister(t *testing.T) {
-	s := NewServer()
+	s := NewServerWithDefaults()
 
 	var frame TCPFrame
 	frame.TransactionIdentifier = 1
@@ -195,9 +226,258 @@ func TestWriteHoldingRegister(t *testing.T) {
 	}
 }
 
+// Function 7
+func TestReadExceptionStatus(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.SetExceptionStatus(0x6D)
+
+	var frame TCPFrame
+	frame.TransactionIdentifier = 1
+	frame.ProtocolIdentifier = 0
+	frame.Length = 2
+	frame.Device = 255
+	frame.Function = 7
+
+	var req Request
+	req.frame = &frame
+	response := s.handle(&req)
+	exception := GetException(response)
+	if exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+		t.FailNow()
+	}
+	expect := []byte{0, 1, 0, 0, 0, 3, 255, 7, 0x6D}
+	got := response.Bytes()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v\n", expect, got)
+	}
+
+	// The status can change while requests are handled.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.handle(&req)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		s.SetExceptionStatus(byte(i))
+	}
+	<-done
+	if status := s.ExceptionStatus(); status != 99 {
+		t.Errorf("expected 99, got %v", status)
+	}
+}
+
+// Function 8
+func TestDiagnostics(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	var frame TCPFrame
+	frame.TransactionIdentifier = 1
+	frame.ProtocolIdentifier = 0
+	frame.Device = 255
+	frame.Function = 8
+
+	var req Request
+	req.frame = &frame
+
+	// Return Query Data
+	frame.SetData([]byte{0, 0, 0xA5, 0x37, 0x42})
+	response := s.handle(&req)
+	exception := GetException(response)
+	if exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+		t.FailNow()
+	}
+	expect := []byte{0, 0, 0xA5, 0x37, 0x42}
+	got := response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v\n", expect, got)
+	}
+
+	// An exception is counted as well.
+	frame.Function = 255
+	s.handle(&req)
+	frame.Function = 8
+
+	// Return Bus Message Count, including this request.
+	frame.SetData([]byte{0, 0x0B, 0, 0})
+	response = s.handle(&req)
+	expect = []byte{0, 0x0B, 0, 3}
+	got = response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v\n", expect, got)
+	}
+
+	// Return Bus Exception Error Count
+	frame.SetData([]byte{0, 0x0D, 0, 0})
+	response = s.handle(&req)
+	expect = []byte{0, 0x0D, 0, 1}
+	got = response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v\n", expect, got)
+	}
+
+	// Clear Counters and Diagnostic Register
+	s.SetDiagnosticRegister(0x1234)
+	frame.SetData([]byte{0, 0x0A, 0, 0})
+	response = s.handle(&req)
+	expect = []byte{0, 0x0A, 0, 0}
+	got = response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v\n", expect, got)
+	}
+	if !isEqual(DiagnosticCounters{}, s.Diagnostics()) || s.DiagnosticRegister() != 0 {
+		t.Errorf("expected cleared counters, got %v, %v\n", s.Diagnostics(), s.DiagnosticRegister())
+	}
+
+	// Return Server Message Count
+	frame.SetData([]byte{0, 0x0E, 0, 0})
+	response = s.handle(&req)
+	expect = []byte{0, 0x0E, 0, 1}
+	got = response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v\n", expect, got)
+	}
+
+	// Unknown sub-function
+	frame.SetData([]byte{0, 0x15, 0, 0})
+	response = s.handle(&req)
+	exception = GetException(response)
+	if exception != IllegalFunction {
+		t.Errorf("expected IllegalFunction, got %v", exception.String())
+	}
+	expect = []byte{0, 1, 0, 0, 0, 3, 255, 0x88, 1}
+	got = response.Bytes()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v\n", expect, got)
+	}
+}
+
+func TestUpdateDiagnostics(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	var frame TCPFrame
+	frame.Device = 255
+	frame.Function = 8
+	// Return Server NAK Count
+	frame.SetData([]byte{0, 0x10, 0, 0})
+
+	var req Request
+	req.frame = &frame
+
+	// The application counts while requests are handled.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.handle(&req)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		s.UpdateDiagnostics(func(counters *DiagnosticCounters) {
+			counters.ServerNAK++
+		})
+		s.SetDiagnosticRegister(uint16(i))
+	}
+	<-done
+
+	expect := []byte{0, 0x10, 0, 100}
+	got := s.handle(&req).GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v\n", expect, got)
+	}
+	if register := s.DiagnosticRegister(); register != 99 {
+		t.Errorf("expected 99, got %v", register)
+	}
+}
+
+// Function 11
+func TestGetCommEventCounter(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	var frame TCPFrame
+	frame.TransactionIdentifier = 1
+	frame.ProtocolIdentifier = 0
+	frame.Device = 255
+
+	var req Request
+	req.frame = &frame
+
+	// A successful read is counted, an exception is not.
+	frame.Function = 7
+	s.handle(&req)
+	frame.Function = 255
+	s.handle(&req)
+
+	frame.Function = 11
+	response := s.handle(&req)
+	exception := GetException(response)
+	if exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+		t.FailNow()
+	}
+	expect := []byte{0, 0, 0, 1}
+	got := response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v\n", expect, got)
+	}
+
+	// The counter is not incremented by Get Comm Event Counter itself.
+	response = s.handle(&req)
+	got = response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v\n", expect, got)
+	}
+}
+
+// Function 12
+func TestGetCommEventLog(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	var frame TCPFrame
+	frame.TransactionIdentifier = 1
+	frame.ProtocolIdentifier = 0
+	frame.Device = 255
+
+	var req Request
+	req.frame = &frame
+
+	frame.Function = 7
+	s.handle(&req)
+	frame.Function = 255
+	s.handle(&req)
+	s.badFrame(nil, nil)
+
+	frame.Function = 12
+	response := s.handle(&req)
+	exception := GetException(response)
+	if exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+		t.FailNow()
+	}
+	// The most recent event comes first.
+	expect := []byte{12, 0, 0, 0, 1, 0, 3, 0x80, 0x82, 0x41, 0x80, 0x40, 0x80}
+	got := response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v\n", expect, got)
+	}
+
+	// The log holds the most recent events only.
+	for i := 0; i < maxCommEvents; i++ {
+		s.handle(&req)
+	}
+	response = s.handle(&req)
+	got = response.GetData()
+	if len(got) != 7+maxCommEvents || got[0] != 6+maxCommEvents {
+		t.Errorf("expected %v events, got %v\n", maxCommEvents, got)
+	}
+}
+
 // Function 15
 func TestWriteMultipleCoils(t *testing.T) {
-	s := NewServer()
+	s := NewServerWithDefaults()
 
 	var frame TCPFrame
 	frame.TransactionIdentifier = 1
@@ -222,9 +502,48 @@ func TestWriteMultipleCoils(t *testing.T) {
 	}
 }
 
+func TestWriteMultipleCoilsByteCount(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	var frame TCPFrame
+	frame.Device = 255
+	frame.Function = 15
+	var req Request
+	req.frame = &frame
+
+	for _, data := range [][]byte{
+		// 9 coils need 2 bytes.
+		{0, 1, 0, 9, 1, 0xFF},
+		{0, 1, 0, 9, 3, 0xFF, 0x01, 0x00},
+		// The byte count does not match the data.
+		{0, 1, 0, 9, 2, 0xFF},
+		{0, 1, 0, 9, 2, 0xFF, 0x01, 0x00},
+		// Missing byte count.
+		{0, 1, 0, 9},
+	} {
+		frame.SetData(data)
+		if exception := GetException(s.handle(&req)); exception != IllegalDataValue {
+			t.Errorf("%v: expected IllegalDataValue, got %v", data, exception.String())
+		}
+	}
+	if s.Coils[1] != 0 {
+		t.Errorf("expected 0, got %v", s.Coils[1])
+	}
+
+	frame.SetData([]byte{0, 1, 0, 9, 2, 0xFF, 0x01})
+	if exception := GetException(s.handle(&req)); exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+	}
+	expect := []byte{1, 1, 1, 1, 1, 1, 1, 1, 1, 0}
+	got := s.Coils[1:11]
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v\n", expect, got)
+	}
+}
+
 // Function 16
 func TestWriteHoldingRegisters(t *testing.T) {
-	s := NewServer()
+	s := NewServerWithDefaults()
 
 	var frame TCPFrame
 	frame.TransactionIdentifier = 1
@@ -249,6 +568,695 @@ func TestWriteHoldingRegisters(t *testing.T) {
 	}
 }
 
+// Function 17
+func TestReportServerID(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.ServerID = []byte("mbserver")
+	s.SetRunIndicator(true)
+
+	var frame TCPFrame
+	frame.TransactionIdentifier = 1
+	frame.ProtocolIdentifier = 0
+	frame.Length = 2
+	frame.Device = 255
+	frame.Function = 17
+
+	var req Request
+	req.frame = &frame
+	response := s.handle(&req)
+	exception := GetException(response)
+	if exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+		t.FailNow()
+	}
+	expect := append(append([]byte{9}, "mbserver"...), 0xFF)
+	got := response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v\n", expect, got)
+	}
+
+	s.ServerID = nil
+	s.SetRunIndicator(false)
+	response = s.handle(&req)
+	expect = []byte{1, 0x00}
+	got = response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v\n", expect, got)
+	}
+
+	// The run indicator can change while requests are handled.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.handle(&req)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		s.SetRunIndicator(i%2 == 0)
+	}
+	<-done
+	if s.RunIndicator() {
+		t.Errorf("expected false, got %v", s.RunIndicator())
+	}
+}
+
+// Function 20
+func TestReadFileRecord(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.FileRecords = map[uint16][]uint16{
+		3: {0, 0, 0, 0, 0x0DFE, 0x0020},
+		4: {0, 0, 0x33CD, 0x0040},
+	}
+
+	var frame TCPFrame
+	frame.TransactionIdentifier = 1
+	frame.ProtocolIdentifier = 0
+	frame.Device = 255
+	frame.Function = 20
+	// Example from the Modbus application protocol specification.
+	frame.SetData([]byte{0x0E, 6, 0, 4, 0, 1, 0, 2, 6, 0, 3, 0, 4, 0, 2})
+
+	var req Request
+	req.frame = &frame
+	response := s.handle(&req)
+	exception := GetException(response)
+	if exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+		t.FailNow()
+	}
+	expect := []byte{0x0C, 5, 6, 0, 0, 0x33, 0xCD, 5, 6, 0x0D, 0xFE, 0, 0x20}
+	got := response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v\n", expect, got)
+	}
+
+	// Record out of range.
+	frame.SetData([]byte{0x07, 6, 0, 4, 0, 3, 0, 2})
+	response = s.handle(&req)
+	exception = GetException(response)
+	if exception != IllegalDataAddress {
+		t.Errorf("expected IllegalDataAddress, got %v", exception.String())
+	}
+
+	// Unknown file.
+	frame.SetData([]byte{0x07, 6, 0, 5, 0, 0, 0, 1})
+	response = s.handle(&req)
+	exception = GetException(response)
+	if exception != IllegalDataAddress {
+		t.Errorf("expected IllegalDataAddress, got %v", exception.String())
+	}
+
+	// Truncated sub-request.
+	frame.SetData([]byte{0x07, 6, 0, 4, 0, 0, 0})
+	response = s.handle(&req)
+	exception = GetException(response)
+	if exception != IllegalDataValue {
+		t.Errorf("expected IllegalDataValue, got %v", exception.String())
+	}
+}
+
+// Function 21
+func TestWriteFileRecord(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.FileRecords = map[uint16][]uint16{
+		4: {0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+	}
+
+	var frame TCPFrame
+	frame.TransactionIdentifier = 1
+	frame.ProtocolIdentifier = 0
+	frame.Device = 255
+	frame.Function = 21
+	// Example from the Modbus application protocol specification, plus a
+	// group for a new file.
+	request := []byte{
+		0x16,
+		6, 0, 4, 0, 7, 0, 3, 0x06, 0xAF, 0x04, 0xBE, 0x10, 0x0D,
+		6, 0, 9, 0, 1, 0, 1, 0x12, 0x34,
+	}
+	frame.SetData(request)
+
+	var req Request
+	req.frame = &frame
+	response := s.handle(&req)
+	exception := GetException(response)
+	if exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+		t.FailNow()
+	}
+	got := response.GetData()
+	if !isEqual(request, got) {
+		t.Errorf("expected %v, got %v\n", request, got)
+	}
+	expect := []uint16{0x06AF, 0x04BE, 0x100D}
+	if !isEqual(expect, s.FileRecords[4][7:10]) {
+		t.Errorf("expected %v, got %v\n", expect, s.FileRecords[4][7:10])
+	}
+	expect = []uint16{0, 0x1234}
+	if !isEqual(expect, s.FileRecords[9]) {
+		t.Errorf("expected %v, got %v\n", expect, s.FileRecords[9])
+	}
+
+	// Record data shorter than the record length.
+	frame.SetData([]byte{0x0B, 6, 0, 4, 0, 0, 0, 3, 0, 1, 0, 2})
+	response = s.handle(&req)
+	exception = GetException(response)
+	if exception != IllegalDataValue {
+		t.Errorf("expected IllegalDataValue, got %v", exception.String())
+	}
+	if s.FileRecords[4][0] != 0 {
+		t.Errorf("expected %v, got %v\n", 0, s.FileRecords[4][0])
+	}
+}
+
+// Function 22
+func TestMaskWriteRegister(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.HoldingRegisters[4] = 0x12
+
+	var frame TCPFrame
+	frame.TransactionIdentifier = 1
+	frame.ProtocolIdentifier = 0
+	frame.Device = 255
+	frame.Function = 22
+	frame.SetData([]byte{0, 4, 0, 0xF2, 0, 0x25})
+
+	var req Request
+	req.frame = &frame
+	response := s.handle(&req)
+	exception := GetException(response)
+	if exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+		t.FailNow()
+	}
+	expect := []byte{0, 4, 0, 0xF2, 0, 0x25}
+	got := response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v\n", expect, got)
+	}
+	// Example from the Modbus application protocol specification.
+	if s.HoldingRegisters[4] != 0x17 {
+		t.Errorf("expected %v, got %v\n", 0x17, s.HoldingRegisters[4])
+	}
+
+	s.HoldingRegisters = s.HoldingRegisters[:4]
+	response = s.handle(&req)
+	exception = GetException(response)
+	if exception != IllegalDataAddress {
+		t.Errorf("expected IllegalDataAddress, got %v", exception.String())
+	}
+}
+
+// Function 23
+func TestReadWriteMultipleRegisters(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.HoldingRegisters[1] = 1
+	s.HoldingRegisters[2] = 2
+
+	var frame TCPFrame
+	frame.TransactionIdentifier = 1
+	frame.ProtocolIdentifier = 0
+	frame.Device = 255
+	frame.Function = 23
+	// Read 1-3, write 2-3.
+	frame.SetData([]byte{0, 1, 0, 3, 0, 2, 0, 2, 4, 0, 5, 0, 6})
+
+	var req Request
+	req.frame = &frame
+	response := s.handle(&req)
+	exception := GetException(response)
+	if exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+		t.FailNow()
+	}
+	// The overlapping registers are read after being written.
+	expect := []byte{6, 0, 1, 0, 5, 0, 6}
+	got := response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v\n", expect, got)
+	}
+
+	// Byte count does not match the write quantity.
+	frame.SetData([]byte{0, 1, 0, 3, 0, 2, 0, 2, 2, 0, 5})
+	response = s.handle(&req)
+	exception = GetException(response)
+	if exception != IllegalDataValue {
+		t.Errorf("expected IllegalDataValue, got %v", exception.String())
+	}
+
+	// Read quantity is zero.
+	frame.SetData([]byte{0, 1, 0, 0, 0, 2, 0, 1, 2, 0, 5})
+	response = s.handle(&req)
+	exception = GetException(response)
+	if exception != IllegalDataValue {
+		t.Errorf("expected IllegalDataValue, got %v", exception.String())
+	}
+
+	// Write past the end of memory.
+	frame.SetData([]byte{0, 1, 0, 1, 255, 255, 0, 2, 4, 0, 7, 0, 7})
+	response = s.handle(&req)
+	exception = GetException(response)
+	if exception != IllegalDataAddress {
+		t.Errorf("expected IllegalDataAddress, got %v", exception.String())
+	}
+	if s.HoldingRegisters[65535] != 0 {
+		t.Errorf("expected %v, got %v\n", 0, s.HoldingRegisters[65535])
+	}
+
+	// Read past the end of memory, the write in range is not performed.
+	frame.SetData([]byte{255, 255, 0, 2, 0, 1, 0, 1, 2, 0, 9})
+	response = s.handle(&req)
+	exception = GetException(response)
+	if exception != IllegalDataAddress {
+		t.Errorf("expected IllegalDataAddress, got %v", exception.String())
+	}
+	if s.HoldingRegisters[1] != 1 {
+		t.Errorf("expected %v, got %v\n", 1, s.HoldingRegisters[1])
+	}
+}
+
+func TestReadWriteMultipleRegistersLimits(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	var frame TCPFrame
+	frame.Device = 255
+	frame.Function = 23
+	var req Request
+	req.frame = &frame
+
+	for _, test := range []struct {
+		read, write uint16
+		expect      Exception
+	}{
+		{1, 1, Success},
+		{125, 121, Success},
+		{0, 1, IllegalDataValue},
+		{126, 1, IllegalDataValue},
+		{1, 0, IllegalDataValue},
+		{1, 122, IllegalDataValue},
+	} {
+		data := make([]byte, 9+test.write*2)
+		binary.BigEndian.PutUint16(data[2:4], test.read)
+		binary.BigEndian.PutUint16(data[6:8], test.write)
+		data[8] = byte(test.write * 2)
+		frame.SetData(data)
+		if exception := GetException(s.handle(&req)); exception != test.expect {
+			t.Errorf("read %d, write %d: expected %v, got %v", test.read, test.write, test.expect.String(), exception.String())
+		}
+	}
+}
+
+// Function 24
+func TestReadFIFOQueue(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.SetFIFOQueue(0x04DE, []uint16{0x01B8, 0x1284})
+
+	var frame TCPFrame
+	frame.TransactionIdentifier = 1
+	frame.ProtocolIdentifier = 0
+	frame.Device = 255
+	frame.Function = 24
+	frame.SetData([]byte{0x04, 0xDE})
+
+	var req Request
+	req.frame = &frame
+	response := s.handle(&req)
+	exception := GetException(response)
+	if exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+		t.FailNow()
+	}
+	// Example from the Modbus application protocol specification.
+	expect := []byte{0, 6, 0, 2, 0x01, 0xB8, 0x12, 0x84}
+	got := response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v\n", expect, got)
+	}
+
+	// No queue configured.
+	frame.SetData([]byte{0, 1})
+	response = s.handle(&req)
+	expect = []byte{0, 2, 0, 0}
+	got = response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v\n", expect, got)
+	}
+
+	// Queue too long.
+	s.SetFIFOQueue(1, make([]uint16, 32))
+	response = s.handle(&req)
+	exception = GetException(response)
+	if exception != IllegalDataValue {
+		t.Errorf("expected IllegalDataValue, got %v", exception.String())
+	}
+}
+
+// Function 43, MEI type 14
+func TestReadDeviceIdentification(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.DeviceIdentification = DeviceIdentification{
+		VendorName:         "ACME",
+		ProductCode:        "X1",
+		MajorMinorRevision: "1.0",
+		ModelName:          "M",
+	}
+
+	var frame TCPFrame
+	frame.TransactionIdentifier = 1
+	frame.ProtocolIdentifier = 0
+	frame.Device = 255
+	frame.Function = 43
+
+	var req Request
+	req.frame = &frame
+
+	// Basic stream access.
+	frame.SetData([]byte{0x0E, 0x01, 0x00})
+	response := s.handle(&req)
+	exception := GetException(response)
+	if exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+		t.FailNow()
+	}
+	expect := []byte{0x0E, 0x01, 0x82, 0x00, 0x00, 3, 0x00, 4, 'A', 'C', 'M', 'E', 0x01, 2, 'X', '1', 0x02, 3, '1', '.', '0'}
+	got := response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v\n", expect, got)
+	}
+
+	// Regular stream access from the revision, skipping empty objects.
+	frame.SetData([]byte{0x0E, 0x02, 0x02})
+	response = s.handle(&req)
+	expect = []byte{0x0E, 0x02, 0x82, 0x00, 0x00, 2, 0x02, 3, '1', '.', '0', 0x05, 1, 'M'}
+	got = response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v\n", expect, got)
+	}
+
+	// Individual access.
+	frame.SetData([]byte{0x0E, 0x04, 0x01})
+	response = s.handle(&req)
+	expect = []byte{0x0E, 0x04, 0x82, 0x00, 0x00, 1, 0x01, 2, 'X', '1'}
+	got = response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v\n", expect, got)
+	}
+
+	// Individual access to an unknown object.
+	frame.SetData([]byte{0x0E, 0x04, 0x04})
+	response = s.handle(&req)
+	exception = GetException(response)
+	if exception != IllegalDataAddress {
+		t.Errorf("expected IllegalDataAddress, got %v", exception.String())
+	}
+
+	// Unknown read device ID code.
+	frame.SetData([]byte{0x0E, 0x05, 0x00})
+	response = s.handle(&req)
+	exception = GetException(response)
+	if exception != IllegalDataValue {
+		t.Errorf("expected IllegalDataValue, got %v", exception.String())
+	}
+
+	// Objects that do not fit are left for the next request.
+	s.DeviceIdentification.Extended = map[byte]string{
+		0x80: string(make([]byte, 200)),
+		0x81: string(make([]byte, 200)),
+	}
+	frame.SetData([]byte{0x0E, 0x03, 0x00})
+	response = s.handle(&req)
+	got = response.GetData()
+	if got[2] != 0x83 || got[3] != 0xFF || got[4] != 0x81 || got[5] != 5 {
+		t.Errorf("expected more to follow from 0x81, got %v\n", got[:6])
+	}
+}
+
+func TestQuantityLimits(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	var frame TCPFrame
+	frame.Device = 255
+	var req Request
+	req.frame = &frame
+
+	for _, test := range []struct {
+		function uint8
+		limit    uint16
+	}{
+		{1, 2000},
+		{2, 2000},
+		{3, 125},
+		{4, 125},
+		{15, 1968},
+		{16, 123},
+	} {
+		frame.Function = test.function
+		for _, number := range []uint16{0, 1, test.limit, test.limit + 1} {
+			switch test.function {
+			case 15:
+				SetDataWithRegisterAndNumberAndBytes(&frame, 0, number, make([]byte, (number+7)/8))
+			case 16:
+				SetDataWithRegisterAndNumberAndValues(&frame, 0, number, make([]uint16, number))
+			default:
+				SetDataWithRegisterAndNumber(&frame, 0, number)
+			}
+
+			expect := Success
+			if number == 0 || number > test.limit {
+				expect = IllegalDataValue
+			}
+			if exception := GetException(s.handle(&req)); exception != expect {
+				t.Errorf("function %d, %d values: expected %v, got %v", test.function, number, expect.String(), exception.String())
+			}
+		}
+	}
+}
+
+func TestAddressAndValueExceptions(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.AllocateMemory(16, 16, 16, 16)
+
+	var frame TCPFrame
+	frame.Device = 255
+	var req Request
+	req.frame = &frame
+
+	for _, test := range []struct {
+		function uint8
+		data     []byte
+		expect   Exception
+	}{
+		// Addresses past the end of the memory.
+		{1, []byte{0, 16, 0, 1}, IllegalDataAddress},
+		{2, []byte{0, 15, 0, 2}, IllegalDataAddress},
+		{3, []byte{0, 16, 0, 1}, IllegalDataAddress},
+		{4, []byte{0, 15, 0, 2}, IllegalDataAddress},
+		{5, []byte{0, 16, 0xFF, 0x00}, IllegalDataAddress},
+		{6, []byte{0, 16, 0, 1}, IllegalDataAddress},
+		{15, []byte{0, 16, 0, 1, 1, 1}, IllegalDataAddress},
+		{16, []byte{0, 16, 0, 1, 2, 0, 1}, IllegalDataAddress},
+		// Bad values, checked before the address.
+		{1, []byte{0, 16, 0, 0}, IllegalDataValue},
+		{3, []byte{0, 16, 0, 126}, IllegalDataValue},
+		{5, []byte{0, 16, 0x00, 0x01}, IllegalDataValue},
+		{15, []byte{0, 16, 0, 1, 2, 1, 0}, IllegalDataValue},
+		{16, []byte{0, 16, 0, 2, 2, 0, 1}, IllegalDataValue},
+		{16, []byte{0, 16, 0, 1, 2, 0, 1, 0, 2}, IllegalDataValue},
+		// Requests of the wrong length.
+		{1, []byte{0, 0}, IllegalDataValue},
+		{2, []byte{0, 0, 0, 1, 0}, IllegalDataValue},
+		{3, []byte{0}, IllegalDataValue},
+		{4, []byte{0, 0, 0}, IllegalDataValue},
+		{5, []byte{0, 0, 0xFF}, IllegalDataValue},
+		{6, []byte{0, 0, 0, 1, 0}, IllegalDataValue},
+		{16, []byte{0, 0, 0, 1}, IllegalDataValue},
+	} {
+		frame.Function = test.function
+		frame.SetData(test.data)
+		if exception := GetException(s.handle(&req)); exception != test.expect {
+			t.Errorf("function %d, %v: expected %v, got %v", test.function, test.data, test.expect.String(), exception.String())
+		}
+	}
+}
+
+func TestWriteBeyondEnd(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.AllocateMemory(16, 16, 4, 4)
+
+	var frame TCPFrame
+	frame.Device = 255
+	var req Request
+	req.frame = &frame
+
+	// Each write starts inside the memory and ends past it.
+	frame.Function = 15
+	SetDataWithRegisterAndNumberAndBytes(&frame, 14, 3, []byte{0x07})
+	if exception := GetException(s.handle(&req)); exception != IllegalDataAddress {
+		t.Errorf("expected IllegalDataAddress, got %v", exception.String())
+	}
+
+	frame.Function = 16
+	SetDataWithRegisterAndNumberAndValues(&frame, 2, 3, []uint16{1, 2, 3})
+	if exception := GetException(s.handle(&req)); exception != IllegalDataAddress {
+		t.Errorf("expected IllegalDataAddress, got %v", exception.String())
+	}
+
+	frame.Function = 23
+	frame.SetData([]byte{0, 0, 0, 1, 0, 3, 0, 2, 4, 0, 1, 0, 2})
+	if exception := GetException(s.handle(&req)); exception != IllegalDataAddress {
+		t.Errorf("expected IllegalDataAddress, got %v", exception.String())
+	}
+
+	// More values than registers is a bad value, not a bad address.
+	frame.Function = 16
+	SetDataWithRegisterAndNumberAndValues(&frame, 0, 1, []uint16{1, 2})
+	if exception := GetException(s.handle(&req)); exception != IllegalDataValue {
+		t.Errorf("expected IllegalDataValue, got %v", exception.String())
+	}
+
+	for i, value := range s.Coils {
+		if value != 0 {
+			t.Errorf("expected coil %d unchanged, got %v", i, value)
+		}
+	}
+	for i, value := range s.HoldingRegisters {
+		if value != 0 {
+			t.Errorf("expected register %d unchanged, got %v", i, value)
+		}
+	}
+}
+
+func TestWriteMultipleAtomic(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	// OnWrite can read back the whole write applied.
+	s.OnWrite = func(unitID, code uint8, address uint16, values []uint16) {
+		var got []uint16
+		if code == 15 {
+			coils, err := s.GetCoils(address, uint16(len(values)))
+			if err != nil {
+				t.Errorf("expected nil, got %v", err)
+				return
+			}
+			got = make([]uint16, len(coils))
+			for i, on := range coils {
+				if on {
+					got[i] = 1
+				}
+			}
+		} else {
+			var err error
+			if got, err = s.GetHoldingRegisters(address, uint16(len(values))); err != nil {
+				t.Errorf("expected nil, got %v", err)
+				return
+			}
+		}
+		for i, value := range values {
+			if got[i] != value {
+				t.Errorf("function %d: expected %v at %d, got %v", code, value, i, got[i])
+				return
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			values := make([]uint16, 123)
+			for j := range values {
+				values[j] = uint16(i) * 0x0101
+			}
+			req := Request{frame: NewWriteMultipleRegistersRequest(1, 0, values)}
+			s.handle(&req)
+
+			coils := make([]bool, 1968)
+			for j := range coils {
+				coils[j] = i%2 == 0
+			}
+			req.frame = NewWriteMultipleCoilsRequest(1, 0, coils)
+			s.handle(&req)
+		}
+	}()
+
+	// Concurrent reads never see half of a write.
+	registers := Request{frame: NewReadHoldingRegistersRequest(1, 0, 123)}
+	coils := Request{frame: NewReadCoilsRequest(1, 0, 1968)}
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		data := s.handle(&registers).GetData()[1:]
+		for _, b := range data[1:] {
+			if b != data[0] {
+				t.Fatalf("expected equal registers, got %v", data)
+			}
+		}
+		data = s.handle(&coils).GetData()[1:]
+		for _, b := range data {
+			if b != data[0] {
+				t.Fatalf("expected equal coils, got %v", data)
+			}
+		}
+	}
+}
+
+func TestOnWrite(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	type write struct {
+		unitID  uint8
+		code    uint8
+		address uint16
+		values  []uint16
+	}
+	var writes []write
+	s.OnWrite = func(unitID, code uint8, address uint16, values []uint16) {
+		writes = append(writes, write{unitID, code, address, values})
+	}
+
+	var frame TCPFrame
+	frame.Device = 255
+	var req Request
+	req.frame = &frame
+
+	frame.Function = 5
+	frame.SetData([]byte{0, 1, 0xFF, 0x00})
+	s.handle(&req)
+
+	frame.Function = 6
+	frame.SetData([]byte{0, 2, 0x12, 0x34})
+	s.handle(&req)
+
+	frame.Function = 15
+	frame.SetData([]byte{0, 3, 0, 10, 2, 0xCD, 0x01})
+	s.handle(&req)
+
+	frame.Function = 16
+	frame.SetData([]byte{0, 4, 0, 2, 4, 0, 1, 0, 2})
+	s.handle(&req)
+
+	expect := []write{
+		{255, 5, 1, []uint16{1}},
+		{255, 6, 2, []uint16{0x1234}},
+		{255, 15, 3, []uint16{1, 0, 1, 1, 0, 0, 1, 1, 1, 0}},
+		{255, 16, 4, []uint16{1, 2}},
+	}
+	if len(writes) != len(expect) {
+		t.Fatalf("expected %v writes, got %v", len(expect), len(writes))
+	}
+	for i, w := range writes {
+		e := expect[i]
+		if w.unitID != e.unitID || w.code != e.code || w.address != e.address || !isEqual(Uint16ToBytes(e.values), Uint16ToBytes(w.values)) {
+			t.Errorf("expected %v, got %v", e, w)
+		}
+	}
+}
+
 func TestBytesToUint16(t *testing.T) {
 	bytes := []byte{1, 2, 3, 4}
 	got := BytesToUint16(bytes)
@@ -268,7 +1276,7 @@ func TestUint16ToBytes(t *testing.T) {
 }
 
 func TestOutOfBounds(t *testing.T) {
-	s := NewServer()
+	s := NewServerWithDefaults()
 
 	var frame TCPFrame
 	frame.TransactionIdentifier = 1
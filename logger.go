@@ -0,0 +1,92 @@
+package mbserver
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Logger is the interface used by the server to log messages. It is
+// satisfied by *log.Logger and is easily adapted to structured loggers.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// stdLogger writes to the standard log package.
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	logger := s.Logger
+	if logger == nil {
+		logger = stdLogger{}
+	}
+	logger.Printf(format, v...)
+}
+
+// dumpFrame logs a hex dump of the frame when Debug is set.
+func (s *Server) dumpFrame(direction string, frame Framer) {
+	if !s.Debug {
+		return
+	}
+
+	header := fmt.Sprintf("unit %d function %d", frame.GetUnitID(), frame.GetFunction())
+	if tcpFrame, ok := frame.(*TCPFrame); ok {
+		header = fmt.Sprintf("transaction %d %s", tcpFrame.TransactionIdentifier, header)
+	}
+	s.logf("%s %s: % x\n", direction, header, frame.Bytes())
+}
+
+// AccessLogEntry records a request handled by the server.
+type AccessLogEntry struct {
+	Time time.Time
+	// RemoteAddr is the host of the TCP/IP client, User and Role are from
+	// its TLS client certificate. They are empty when not known.
+	RemoteAddr string
+	User       string
+	Role       string
+	UnitID     uint8
+	Function   uint8
+	// Exception is Success for normal responses and requests without a
+	// response.
+	Exception     Exception
+	RequestBytes  int
+	ResponseBytes int
+	// TLSVersion and CipherSuite are those negotiated by TLS clients, zero
+	// for other clients.
+	TLSVersion  uint16
+	CipherSuite uint16
+}
+
+// accessLog calls AccessLog, if set, for the request and its response, nil
+// when no response is sent.
+func (s *Server) accessLog(request *Request, response Framer) {
+	if s.AccessLog == nil {
+		return
+	}
+
+	entry := AccessLogEntry{
+		Time:         time.Now(),
+		UnitID:       request.frame.GetUnitID(),
+		Function:     request.frame.GetFunction(),
+		RequestBytes: len(request.frame.Bytes()),
+	}
+	if ctx := request.ctx; ctx != nil {
+		entry.RemoteAddr, _ = RemoteAddrFromContext(ctx)
+		entry.User, _ = UserFromContext(ctx)
+		entry.Role, _ = RoleFromContext(ctx)
+		if state, ok := TLSStateFromContext(ctx); ok {
+			entry.TLSVersion = state.Version
+			entry.CipherSuite = state.CipherSuite
+		}
+	}
+	if response != nil {
+		entry.Exception = GetException(response)
+		entry.ResponseBytes = len(response.Bytes())
+	}
+
+	s.AccessLog(entry)
+}
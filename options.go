@@ -0,0 +1,107 @@
+package mbserver
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+// Option configures a server created by NewServerWithOptions.
+type Option func(*Server)
+
+// NewServerWithOptions creates a new Modbus server (slave) with default
+// function handlers and registers, configured by the options. The server's
+// handler is started once all options have been applied.
+func NewServerWithOptions(opts ...Option) *Server {
+	s := newServerWithDefaults()
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.requestChan = make(chan *Request, s.requestQueueSize)
+	go s.handler()
+
+	return s
+}
+
+// WithDebug enables more verbose messaging.
+func WithDebug() Option {
+	return func(s *Server) {
+		s.Debug = true
+	}
+}
+
+// WithLogger sets the logger receiving the server's log messages.
+func WithLogger(logger Logger) Option {
+	return func(s *Server) {
+		s.Logger = logger
+	}
+}
+
+// WithReadOnly rejects all write function codes.
+func WithReadOnly() Option {
+	return func(s *Server) {
+		s.ReadOnly = true
+	}
+}
+
+// WithMaxConnections limits the number of concurrent TCP/IP connections.
+func WithMaxConnections(n int) Option {
+	return func(s *Server) {
+		s.MaxConnections = n
+	}
+}
+
+// WithIdleTimeout closes TCP/IP connections idle for the given duration.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.IdleTimeout = timeout
+	}
+}
+
+// WithKeepAlivePeriod sets the TCP keep-alive period of TCP/IP connections.
+func WithKeepAlivePeriod(period time.Duration) Option {
+	return func(s *Server) {
+		s.KeepAlivePeriod = period
+	}
+}
+
+// WithClientAuth sets the TLS client authentication mode used by ListenTLS.
+func WithClientAuth(clientAuth tls.ClientAuthType) Option {
+	return func(s *Server) {
+		s.ClientAuth = &clientAuth
+	}
+}
+
+// WithMemorySize allocates n discrete inputs, coils, holding registers and
+// input registers instead of the full 65536 of each. Requests beyond them
+// return an IllegalDataAddress exception.
+func WithMemorySize(n int) Option {
+	return func(s *Server) {
+		s.MemoryBank = newMemoryBank(n, n, n, n)
+	}
+}
+
+// WithDataFormat sets the order of values spanning multiple registers used by
+// the register helpers when they are passed DefaultOrder.
+func WithDataFormat(order ByteOrder) Option {
+	return func(s *Server) {
+		s.DataFormat = order
+	}
+}
+
+// WithRequestQueueSize sets the number of received requests queued for the
+// handlers before the queue is full. By default requests are not queued,
+// each waits until a handler is ready.
+func WithRequestQueueSize(n int) Option {
+	return func(s *Server) {
+		s.requestQueueSize = n
+	}
+}
+
+// WithWorkers sets the number of goroutines handling requests.
+func WithWorkers(n int) Option {
+	return func(s *Server) {
+		s.Workers = n
+	}
+}
@@ -0,0 +1,58 @@
+package mbserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewServerWithOptions(t *testing.T) {
+	logger := make(chanLogger, 8)
+	s := NewServerWithOptions(
+		WithLogger(logger),
+		WithReadOnly(),
+		WithMaxConnections(2),
+		WithIdleTimeout(time.Second),
+		WithKeepAlivePeriod(time.Minute),
+		WithMemorySize(10),
+		WithWorkers(4),
+		WithRequestQueueSize(16),
+	)
+
+	if s.Logger != Logger(logger) || !s.ReadOnly || s.MaxConnections != 2 || s.IdleTimeout != time.Second || s.KeepAlivePeriod != time.Minute || s.Workers != 4 {
+		t.Errorf("expected the options to be applied, got %+v", s)
+	}
+	if cap(s.requestChan) != 16 {
+		t.Errorf("expected a queue of 16 requests, got %v", cap(s.requestChan))
+	}
+	if len(s.Coils) != 10 || len(s.DiscreteInputs) != 10 || len(s.HoldingRegisters) != 10 || len(s.InputRegisters) != 10 {
+		t.Errorf("expected 10 of each, got %v, %v, %v and %v",
+			len(s.Coils), len(s.DiscreteInputs), len(s.HoldingRegisters), len(s.InputRegisters))
+	}
+
+	var frame TCPFrame
+	frame.Device = 255
+	var req Request
+	req.frame = &frame
+
+	for _, function := range []uint8{1, 2, 3, 4} {
+		frame.Function = function
+		SetDataWithRegisterAndNumber(&frame, 9, 1)
+		if exception := GetException(s.handle(&req)); exception != Success {
+			t.Errorf("function %d: expected Success, got %v", function, exception.String())
+		}
+
+		SetDataWithRegisterAndNumber(&frame, 9, 2)
+		if exception := GetException(s.handle(&req)); exception != IllegalDataAddress {
+			t.Errorf("function %d: expected IllegalDataAddress, got %v", function, exception.String())
+		}
+	}
+
+	s.ReadOnly = false
+	for _, function := range []uint8{5, 6} {
+		frame.Function = function
+		SetDataWithRegisterAndNumber(&frame, 10, 0xFF00)
+		if exception := GetException(s.handle(&req)); exception != IllegalDataAddress {
+			t.Errorf("function %d: expected IllegalDataAddress, got %v", function, exception.String())
+		}
+	}
+}
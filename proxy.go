@@ -0,0 +1,92 @@
+package mbserver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// proxyTimeout limits a downstream request when the request's context has no
+// earlier deadline.
+const proxyTimeout = 5 * time.Second
+
+// NewProxyHandler returns a handler forwarding requests to the Modbus/TCP
+// device at the other end of downstream and returning its response. Register
+// it for function codes the server does not implement to turn the server into
+// a gateway.
+//
+// Requests are forwarded one at a time, with transaction identifiers of the
+// downstream link's own. An exception from the device is returned as is, a
+// device failing to respond in time returns a
+// GatewayTargetDeviceFailedToRespond exception and a broken link returns a
+// GatewayPathUnavailable exception.
+func NewProxyHandler(downstream net.Conn) ContextFunctionHandler {
+	var (
+		mu            sync.Mutex
+		transactionID uint16
+	)
+
+	return func(ctx context.Context, frame Framer) ([]byte, *Exception) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		transactionID++
+		pdu := frame.GetPDU()
+		request := &TCPFrame{
+			TransactionIdentifier: transactionID,
+			Device:                frame.GetUnitID(),
+			Function:              pdu[0],
+		}
+		request.SetData(pdu[1:])
+
+		deadline := time.Now().Add(proxyTimeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		downstream.SetDeadline(deadline)
+		defer downstream.SetDeadline(time.Time{})
+
+		response, err := proxyRoundTrip(downstream, request)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return []byte{}, &GatewayTargetDeviceFailedToRespond
+			}
+			return []byte{}, &GatewayPathUnavailable
+		}
+
+		if response.Function == request.Function|0x80 {
+			// An exception response carries the exception code.
+			if len(response.Data) != 1 {
+				return []byte{}, &GatewayPathUnavailable
+			}
+			exception := GetException(response)
+			return []byte{}, &exception
+		}
+		return response.Data, &Success
+	}
+}
+
+// proxyRoundTrip writes a request to the downstream device and reads its
+// response, skipping responses to earlier requests that timed out.
+func proxyRoundTrip(downstream net.Conn, request *TCPFrame) (*TCPFrame, error) {
+	if _, err := downstream.Write(request.Bytes()); err != nil {
+		return nil, err
+	}
+
+	for {
+		packet, err := readTCPPacket(downstream)
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := NewTCPFrame(packet)
+		if err != nil {
+			return nil, err
+		}
+		if response.TransactionIdentifier == request.TransactionIdentifier &&
+			response.Function&0x7F == request.Function {
+			return response, nil
+		}
+	}
+}
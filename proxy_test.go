@@ -0,0 +1,70 @@
+package mbserver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyHandler(t *testing.T) {
+	device := NewServerWithDefaults()
+	device.RegisterFunctionHandler(100, func(s *Server, frame Framer) ([]byte, *Exception) {
+		return append([]byte{frame.GetUnitID()}, frame.GetData()...), &Success
+	})
+	downstream, conn := net.Pipe()
+	go device.ServeConn(conn)
+	defer downstream.Close()
+
+	s := NewServerWithDefaults()
+	s.RegisterContextFunctionHandler(100, NewProxyHandler(downstream))
+	s.RegisterContextFunctionHandler(101, NewProxyHandler(downstream))
+
+	var frame TCPFrame
+	frame.TransactionIdentifier = 0x1234
+	frame.Device = 7
+	frame.Function = 100
+	frame.SetData([]byte{1, 2, 3})
+
+	req := Request{ctx: context.Background(), frame: &frame}
+	response := s.handle(&req)
+	expect := []byte{0x12, 0x34, 0, 0, 0, 6, 7, 100, 7, 1, 2, 3}
+	got := response.Bytes()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	// Exceptions from the device are returned to the client.
+	frame.Function = 101
+	response = s.handle(&req)
+	exception := GetException(response)
+	if exception != IllegalFunction {
+		t.Errorf("expected IllegalFunction, got %v", exception.String())
+	}
+}
+
+func TestProxyHandlerTimeout(t *testing.T) {
+	downstream, conn := net.Pipe()
+	defer downstream.Close()
+	defer conn.Close()
+
+	var frame TCPFrame
+	frame.Device = 1
+	frame.Function = 100
+	frame.SetData([]byte{1})
+
+	// The device never reads the request.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, exception := NewProxyHandler(downstream)(ctx, &frame)
+	if *exception != GatewayTargetDeviceFailedToRespond {
+		t.Errorf("expected GatewayTargetDeviceFailedToRespond, got %v", exception.String())
+	}
+
+	// A closed link is reported as an unavailable path.
+	conn.Close()
+	_, exception = NewProxyHandler(downstream)(context.Background(), &frame)
+	if *exception != GatewayPathUnavailable {
+		t.Errorf("expected GatewayPathUnavailable, got %v", exception.String())
+	}
+}
@@ -0,0 +1,39 @@
+package mbserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2)
+	b.last = now
+
+	// A full bucket allows a burst.
+	for i := 0; i < 2; i++ {
+		if !b.allow(now) {
+			t.Errorf("request %d: expected allowed", i)
+		}
+	}
+	if b.allow(now) {
+		t.Errorf("expected the empty bucket to deny")
+	}
+
+	// Tokens are refilled at the rate.
+	if !b.allow(now.Add(500 * time.Millisecond)) {
+		t.Errorf("expected a refilled token")
+	}
+	if b.allow(now.Add(500 * time.Millisecond)) {
+		t.Errorf("expected the empty bucket to deny")
+	}
+
+	// The bucket does not fill beyond the burst.
+	now = now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		b.allow(now)
+	}
+	if b.allow(now) {
+		t.Errorf("expected the empty bucket to deny")
+	}
+}
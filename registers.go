@@ -0,0 +1,317 @@
+package mbserver
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// ByteOrder specifies how a value spanning multiple registers is laid out.
+// The orders are named after the bytes of a 32-bit value, from the most
+// significant byte A to the least significant byte D, as they are sent.
+type ByteOrder int
+
+const (
+	// DefaultOrder uses the server's DataFormat, or ABCD if it is not set.
+	DefaultOrder ByteOrder = iota
+	// ABCD stores the most significant word in the first register, the bytes
+	// within a register are big endian.
+	ABCD
+	// CDAB stores the least significant word in the first register, the
+	// bytes within a register are big endian.
+	CDAB
+	// BADC stores the most significant word in the first register, the
+	// bytes within a register are little endian.
+	BADC
+	// DCBA stores the least significant word in the first register, the
+	// bytes within a register are little endian.
+	DCBA
+)
+
+const (
+	// BigEndian stores the most significant word in the first register.
+	BigEndian = ABCD
+	// LittleEndian stores the least significant word in the first register.
+	LittleEndian = CDAB
+)
+
+// byteOrder returns the order used for the order passed to a register
+// helper.
+func (s *Server) byteOrder(order ByteOrder) ByteOrder {
+	if order == DefaultOrder {
+		order = s.DataFormat
+	}
+	if order == DefaultOrder {
+		order = ABCD
+	}
+	return order
+}
+
+func (order ByteOrder) swapsWords() bool {
+	return order == CDAB || order == DCBA
+}
+
+func (order ByteOrder) swapsBytes() bool {
+	return order == BADC || order == DCBA
+}
+
+// putUint stores a value in the registers.
+func (order ByteOrder) putUint(registers []uint16, value uint64) {
+	for i := len(registers) - 1; i >= 0; i-- {
+		word := uint16(value)
+		value >>= 16
+
+		if order.swapsBytes() {
+			word = bits.ReverseBytes16(word)
+		}
+		if order.swapsWords() {
+			registers[len(registers)-1-i] = word
+		} else {
+			registers[i] = word
+		}
+	}
+}
+
+// getUint returns the value stored in the registers.
+func (order ByteOrder) getUint(registers []uint16) uint64 {
+	var value uint64
+	for i := range registers {
+		word := registers[i]
+		if order.swapsWords() {
+			word = registers[len(registers)-1-i]
+		}
+		if order.swapsBytes() {
+			word = bits.ReverseBytes16(word)
+		}
+		value = value<<16 | uint64(word)
+	}
+	return value
+}
+
+func checkRange(name string, length int, address uint16, count int) error {
+	if int(address)+count > length {
+		return fmt.Errorf("%s %d to %d out of range", name, address, int(address)+count-1)
+	}
+	return nil
+}
+
+// SetHoldingRegister sets the holding register at address.
+func (s *Server) SetHoldingRegister(address uint16, value uint16) error {
+	return s.SetHoldingRegisters(address, []uint16{value})
+}
+
+// GetHoldingRegister returns the holding register at address.
+func (s *Server) GetHoldingRegister(address uint16) (uint16, error) {
+	values, err := s.GetHoldingRegisters(address, 1)
+	if err != nil {
+		return 0, err
+	}
+	return values[0], nil
+}
+
+// SetHoldingRegisters sets the holding registers starting at address.
+func (s *Server) SetHoldingRegisters(start uint16, values []uint16) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := checkRange("holding registers", len(s.HoldingRegisters), start, len(values)); err != nil {
+		return err
+	}
+	copy(s.HoldingRegisters[start:], values)
+	return nil
+}
+
+// GetHoldingRegisters returns a copy of the count holding registers starting
+// at address. The registers are read under the server's lock, so the copy is
+// never torn by a concurrent write.
+func (s *Server) GetHoldingRegisters(start, count uint16) ([]uint16, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if err := checkRange("holding registers", len(s.HoldingRegisters), start, int(count)); err != nil {
+		return nil, err
+	}
+	return append([]uint16{}, s.HoldingRegisters[start:int(start)+int(count)]...), nil
+}
+
+// SetInputRegister sets the input register at address.
+func (s *Server) SetInputRegister(address uint16, value uint16) error {
+	return s.SetInputRegisters(address, []uint16{value})
+}
+
+// GetInputRegister returns the input register at address.
+func (s *Server) GetInputRegister(address uint16) (uint16, error) {
+	values, err := s.GetInputRegisters(address, 1)
+	if err != nil {
+		return 0, err
+	}
+	return values[0], nil
+}
+
+// SetInputRegisters sets the input registers starting at address.
+func (s *Server) SetInputRegisters(start uint16, values []uint16) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := checkRange("input registers", len(s.InputRegisters), start, len(values)); err != nil {
+		return err
+	}
+	copy(s.InputRegisters[start:], values)
+	return nil
+}
+
+// GetInputRegisters returns a copy of the count input registers starting at
+// address. The registers are read under the server's lock, so the copy is
+// never torn by a concurrent write.
+func (s *Server) GetInputRegisters(start, count uint16) ([]uint16, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if err := checkRange("input registers", len(s.InputRegisters), start, int(count)); err != nil {
+		return nil, err
+	}
+	return append([]uint16{}, s.InputRegisters[start:int(start)+int(count)]...), nil
+}
+
+// setHoldingRegisterUint stores a value in count holding registers starting at
+// address.
+func (s *Server) setHoldingRegisterUint(address uint16, count int, value uint64, order ByteOrder) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := checkRange("holding registers", len(s.HoldingRegisters), address, count); err != nil {
+		return err
+	}
+	s.byteOrder(order).putUint(s.HoldingRegisters[address:int(address)+count], value)
+	return nil
+}
+
+// getHoldingRegisterUint returns the value stored in count holding registers
+// starting at address.
+func (s *Server) getHoldingRegisterUint(address uint16, count int, order ByteOrder) (uint64, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if err := checkRange("holding registers", len(s.HoldingRegisters), address, count); err != nil {
+		return 0, err
+	}
+	return s.byteOrder(order).getUint(s.HoldingRegisters[address : int(address)+count]), nil
+}
+
+// SetHoldingRegisterUint32 stores a uint32 in the holding registers at
+// address and address+1.
+func (s *Server) SetHoldingRegisterUint32(address uint16, value uint32, order ByteOrder) error {
+	return s.setHoldingRegisterUint(address, 2, uint64(value), order)
+}
+
+// GetHoldingRegisterUint32 returns the uint32 stored in the holding registers
+// at address and address+1.
+func (s *Server) GetHoldingRegisterUint32(address uint16, order ByteOrder) (uint32, error) {
+	value, err := s.getHoldingRegisterUint(address, 2, order)
+	return uint32(value), err
+}
+
+// SetHoldingRegisterInt32 stores an int32 in the holding registers at address
+// and address+1.
+func (s *Server) SetHoldingRegisterInt32(address uint16, value int32, order ByteOrder) error {
+	return s.SetHoldingRegisterUint32(address, uint32(value), order)
+}
+
+// GetHoldingRegisterInt32 returns the int32 stored in the holding registers
+// at address and address+1.
+func (s *Server) GetHoldingRegisterInt32(address uint16, order ByteOrder) (int32, error) {
+	value, err := s.GetHoldingRegisterUint32(address, order)
+	return int32(value), err
+}
+
+// SetHoldingRegisterFloat32 stores an IEEE 754 float32 in the holding
+// registers at address and address+1.
+func (s *Server) SetHoldingRegisterFloat32(address uint16, value float32, order ByteOrder) error {
+	return s.SetHoldingRegisterUint32(address, math.Float32bits(value), order)
+}
+
+// GetHoldingRegisterFloat32 returns the IEEE 754 float32 stored in the
+// holding registers at address and address+1.
+func (s *Server) GetHoldingRegisterFloat32(address uint16, order ByteOrder) (float32, error) {
+	value, err := s.GetHoldingRegisterUint32(address, order)
+	return math.Float32frombits(value), err
+}
+
+// SetHoldingRegisterUint64 stores a uint64 in the holding registers at address
+// to address+3.
+func (s *Server) SetHoldingRegisterUint64(address uint16, value uint64, order ByteOrder) error {
+	return s.setHoldingRegisterUint(address, 4, value, order)
+}
+
+// GetHoldingRegisterUint64 returns the uint64 stored in the holding registers
+// at address to address+3.
+func (s *Server) GetHoldingRegisterUint64(address uint16, order ByteOrder) (uint64, error) {
+	return s.getHoldingRegisterUint(address, 4, order)
+}
+
+// SetHoldingRegisterInt64 stores an int64 in the holding registers at address
+// to address+3.
+func (s *Server) SetHoldingRegisterInt64(address uint16, value int64, order ByteOrder) error {
+	return s.SetHoldingRegisterUint64(address, uint64(value), order)
+}
+
+// GetHoldingRegisterInt64 returns the int64 stored in the holding registers
+// at address to address+3.
+func (s *Server) GetHoldingRegisterInt64(address uint16, order ByteOrder) (int64, error) {
+	value, err := s.GetHoldingRegisterUint64(address, order)
+	return int64(value), err
+}
+
+// SetHoldingRegisterFloat64 stores an IEEE 754 float64 in the holding
+// registers at address to address+3.
+func (s *Server) SetHoldingRegisterFloat64(address uint16, value float64, order ByteOrder) error {
+	return s.SetHoldingRegisterUint64(address, math.Float64bits(value), order)
+}
+
+// GetHoldingRegisterFloat64 returns the IEEE 754 float64 stored in the
+// holding registers at address to address+3.
+func (s *Server) GetHoldingRegisterFloat64(address uint16, order ByteOrder) (float64, error) {
+	value, err := s.GetHoldingRegisterUint64(address, order)
+	return math.Float64frombits(value), err
+}
+
+// SetHoldingRegistersString stores str in the holding registers starting at
+// address, two characters per register, zero-padding the last register of an
+// odd-length string. Only the order of the bytes within a register applies,
+// BADC and DCBA store the second character of each pair in the high byte.
+func (s *Server) SetHoldingRegistersString(address uint16, str string, order ByteOrder) error {
+	order = s.byteOrder(order)
+
+	values := make([]uint16, (len(str)+1)/2)
+	for i := range values {
+		value := uint16(str[2*i]) << 8
+		if 2*i+1 < len(str) {
+			value |= uint16(str[2*i+1])
+		}
+		if order.swapsBytes() {
+			value = bits.ReverseBytes16(value)
+		}
+		values[i] = value
+	}
+	return s.SetHoldingRegisters(address, values)
+}
+
+// GetHoldingRegistersString returns the string stored in the count holding
+// registers starting at address, without the trailing zero bytes padding it.
+func (s *Server) GetHoldingRegistersString(address uint16, count uint16, order ByteOrder) (string, error) {
+	values, err := s.GetHoldingRegisters(address, count)
+	if err != nil {
+		return "", err
+	}
+	order = s.byteOrder(order)
+
+	str := make([]byte, 0, 2*len(values))
+	for _, value := range values {
+		if order.swapsBytes() {
+			value = bits.ReverseBytes16(value)
+		}
+		str = append(str, byte(value>>8), byte(value))
+	}
+	return string(bytes.TrimRight(str, "\x00")), nil
+}
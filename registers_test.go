@@ -0,0 +1,328 @@
+package mbserver
+
+import "testing"
+
+func TestHoldingRegisterUint32(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	if err := s.SetHoldingRegisterUint32(10, 0x12345678, BigEndian); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expect := []uint16{0x1234, 0x5678}
+	got := s.HoldingRegisters[10:12]
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	if err := s.SetHoldingRegisterUint32(20, 0x12345678, LittleEndian); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expect = []uint16{0x5678, 0x1234}
+	got = s.HoldingRegisters[20:22]
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	value, err := s.GetHoldingRegisterUint32(20, LittleEndian)
+	if err != nil || value != 0x12345678 {
+		t.Errorf("expected %x, got %x, %v", 0x12345678, value, err)
+	}
+}
+
+func TestHoldingRegisterInt32(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	if err := s.SetHoldingRegisterInt32(0, -2, BigEndian); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expect := []uint16{0xFFFF, 0xFFFE}
+	got := s.HoldingRegisters[0:2]
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	value, err := s.GetHoldingRegisterInt32(0, BigEndian)
+	if err != nil || value != -2 {
+		t.Errorf("expected %v, got %v, %v", -2, value, err)
+	}
+}
+
+func TestHoldingRegisterFloat32(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	if err := s.SetHoldingRegisterFloat32(0, 1.5, BigEndian); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expect := []uint16{0x3FC0, 0x0000}
+	got := s.HoldingRegisters[0:2]
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	value, err := s.GetHoldingRegisterFloat32(0, BigEndian)
+	if err != nil || value != 1.5 {
+		t.Errorf("expected %v, got %v, %v", 1.5, value, err)
+	}
+}
+
+func TestHoldingRegisterUint32OutOfRange(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	if err := s.SetHoldingRegisterUint32(65535, 1, BigEndian); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+	if s.HoldingRegisters[65535] != 0 {
+		t.Errorf("expected %v, got %v", 0, s.HoldingRegisters[65535])
+	}
+	if _, err := s.GetHoldingRegisterFloat32(65535, BigEndian); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+}
+
+func TestHoldingRegisterByteOrder(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	for _, test := range []struct {
+		order  ByteOrder
+		expect []uint16
+	}{
+		{ABCD, []uint16{0x1234, 0x5678}},
+		{CDAB, []uint16{0x5678, 0x1234}},
+		{BADC, []uint16{0x3412, 0x7856}},
+		{DCBA, []uint16{0x7856, 0x3412}},
+	} {
+		s.DataFormat = test.order
+		if err := s.SetHoldingRegisterUint32(0, 0x12345678, DefaultOrder); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		got := s.HoldingRegisters[0:2]
+		if !isEqual(test.expect, got) {
+			t.Errorf("%d: expected %v, got %v", test.order, test.expect, got)
+		}
+
+		value, err := s.GetHoldingRegisterUint32(0, test.order)
+		if err != nil || value != 0x12345678 {
+			t.Errorf("%d: expected %x, got %x, %v", test.order, 0x12345678, value, err)
+		}
+	}
+
+	// An explicit order overrides the server's data format.
+	s.DataFormat = DCBA
+	if err := s.SetHoldingRegisterUint32(0, 0x12345678, BigEndian); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expect := []uint16{0x1234, 0x5678}
+	got := s.HoldingRegisters[0:2]
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
+
+func TestHoldingRegisterUint64(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	if err := s.SetHoldingRegisterUint64(10, 0x0123456789ABCDEF, BigEndian); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expect := []uint16{0x0123, 0x4567, 0x89AB, 0xCDEF}
+	got := s.HoldingRegisters[10:14]
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	if err := s.SetHoldingRegisterUint64(20, 0x0123456789ABCDEF, LittleEndian); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expect = []uint16{0xCDEF, 0x89AB, 0x4567, 0x0123}
+	got = s.HoldingRegisters[20:24]
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	value, err := s.GetHoldingRegisterUint64(20, LittleEndian)
+	if err != nil || value != 0x0123456789ABCDEF {
+		t.Errorf("expected %x, got %x, %v", uint64(0x0123456789ABCDEF), value, err)
+	}
+}
+
+func TestHoldingRegisterInt64(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	if err := s.SetHoldingRegisterInt64(0, -2, BigEndian); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expect := []uint16{0xFFFF, 0xFFFF, 0xFFFF, 0xFFFE}
+	got := s.HoldingRegisters[0:4]
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	value, err := s.GetHoldingRegisterInt64(0, BigEndian)
+	if err != nil || value != -2 {
+		t.Errorf("expected %v, got %v, %v", -2, value, err)
+	}
+}
+
+func TestHoldingRegisterFloat64(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	if err := s.SetHoldingRegisterFloat64(0, 1.5, BigEndian); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expect := []uint16{0x3FF8, 0x0000, 0x0000, 0x0000}
+	got := s.HoldingRegisters[0:4]
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	value, err := s.GetHoldingRegisterFloat64(0, BigEndian)
+	if err != nil || value != 1.5 {
+		t.Errorf("expected %v, got %v, %v", 1.5, value, err)
+	}
+}
+
+func TestHoldingRegisterUint64OutOfRange(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	if err := s.SetHoldingRegisterUint64(65533, 1, BigEndian); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+	if s.HoldingRegisters[65535] != 0 {
+		t.Errorf("expected %v, got %v", 0, s.HoldingRegisters[65535])
+	}
+	if _, err := s.GetHoldingRegisterFloat64(65533, BigEndian); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+	if err := s.SetHoldingRegisterUint64(65532, 1, BigEndian); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+}
+
+func TestHoldingRegisters(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	if err := s.SetHoldingRegisters(10, []uint16{1, 2, 3}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	got, err := s.GetHoldingRegisters(10, 3)
+	expect := []uint16{1, 2, 3}
+	if err != nil || !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v, %v", expect, got, err)
+	}
+
+	// The values returned do not share memory with the server.
+	got[0] = 42
+	if value, _ := s.GetHoldingRegister(10); value != 1 {
+		t.Errorf("expected %v, got %v", 1, value)
+	}
+
+	if err := s.SetHoldingRegister(65535, 4); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+	if err := s.SetHoldingRegisters(65535, []uint16{5, 6}); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+	if value, _ := s.GetHoldingRegister(65535); value != 4 {
+		t.Errorf("expected %v, got %v", 4, value)
+	}
+}
+
+func TestHoldingRegistersString(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	if err := s.SetHoldingRegistersString(10, "PUMP1", DefaultOrder); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expect := []uint16{0x5055, 0x4D50, 0x3100}
+	got, _ := s.GetHoldingRegisters(10, 3)
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+	if str, err := s.GetHoldingRegistersString(10, 4, DefaultOrder); err != nil || str != "PUMP1" {
+		t.Errorf("expected PUMP1, got %q, %v", str, err)
+	}
+
+	// Byte swapped orders swap the characters of each register.
+	if err := s.SetHoldingRegistersString(20, "PUMP1", DCBA); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expect = []uint16{0x5550, 0x504D, 0x0031}
+	got, _ = s.GetHoldingRegisters(20, 3)
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+	if str, _ := s.GetHoldingRegistersString(20, 3, BADC); str != "PUMP1" {
+		t.Errorf("expected PUMP1, got %q", str)
+	}
+
+	if err := s.SetHoldingRegistersString(65535, "ABC", DefaultOrder); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+	if _, err := s.GetHoldingRegistersString(65535, 2, DefaultOrder); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+}
+
+func TestInputRegisters(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	if err := s.SetInputRegisters(10, []uint16{1, 2, 3}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	got, err := s.GetInputRegisters(11, 2)
+	expect := []uint16{2, 3}
+	if err != nil || !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v, %v", expect, got, err)
+	}
+
+	if _, err := s.GetInputRegisters(65535, 2); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+	if _, err := s.GetInputRegisters(2, 65535); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+	if _, err := s.GetHoldingRegisters(2, 65535); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+
+	if err := s.SetInputRegister(65535, 4); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+	if value, err := s.GetInputRegister(65535); err != nil || value != 4 {
+		t.Errorf("expected %v, got %v, %v", 4, value, err)
+	}
+	if err := s.SetInputRegister(0, 1); err != nil || s.InputRegisters[0] != 1 {
+		t.Errorf("expected %v, got %v, %v", 1, s.InputRegisters[0], err)
+	}
+}
+
+func TestGetHoldingRegistersAtomic(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			v := uint16(i)
+			s.SetHoldingRegisters(0, []uint16{v, v, v, v})
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		values, err := s.GetHoldingRegisters(0, 4)
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		for _, value := range values[1:] {
+			if value != values[0] {
+				t.Fatalf("expected equal values, got %v", values)
+			}
+		}
+	}
+}
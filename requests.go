@@ -0,0 +1,77 @@
+package mbserver
+
+// newRequest returns a Modbus TCP request frame for the unit.
+func newRequest(unit byte, function uint8, data []byte) *TCPFrame {
+	frame := &TCPFrame{Device: unit, Function: function}
+	frame.SetData(data)
+	return frame
+}
+
+// newAddressRequest returns a request frame whose data is an address
+// followed by a quantity or a value.
+func newAddressRequest(unit byte, function uint8, address, number uint16) *TCPFrame {
+	frame := newRequest(unit, function, nil)
+	SetDataWithRegisterAndNumber(frame, address, number)
+	return frame
+}
+
+// NewReadCoilsRequest returns a Read Coils (function 1) request.
+func NewReadCoilsRequest(unit byte, start, qty uint16) *TCPFrame {
+	return newAddressRequest(unit, 1, start, qty)
+}
+
+// NewReadDiscreteInputsRequest returns a Read Discrete Inputs (function 2)
+// request.
+func NewReadDiscreteInputsRequest(unit byte, start, qty uint16) *TCPFrame {
+	return newAddressRequest(unit, 2, start, qty)
+}
+
+// NewReadHoldingRegistersRequest returns a Read Holding Registers (function
+// 3) request.
+func NewReadHoldingRegistersRequest(unit byte, start, qty uint16) *TCPFrame {
+	return newAddressRequest(unit, 3, start, qty)
+}
+
+// NewReadInputRegistersRequest returns a Read Input Registers (function 4)
+// request.
+func NewReadInputRegistersRequest(unit byte, start, qty uint16) *TCPFrame {
+	return newAddressRequest(unit, 4, start, qty)
+}
+
+// NewWriteSingleCoilRequest returns a Write Single Coil (function 5) request.
+func NewWriteSingleCoilRequest(unit byte, address uint16, on bool) *TCPFrame {
+	var value uint16
+	if on {
+		value = 0xFF00
+	}
+	return newAddressRequest(unit, 5, address, value)
+}
+
+// NewWriteSingleRegisterRequest returns a Write Single Register (function 6)
+// request.
+func NewWriteSingleRegisterRequest(unit byte, address, value uint16) *TCPFrame {
+	return newAddressRequest(unit, 6, address, value)
+}
+
+// NewWriteMultipleCoilsRequest returns a Write Multiple Coils (function 15)
+// request.
+func NewWriteMultipleCoilsRequest(unit byte, start uint16, values []bool) *TCPFrame {
+	bytes := make([]byte, (len(values)+7)/8)
+	for i, on := range values {
+		if on {
+			bytes[i/8] |= 1 << (uint(i) % 8)
+		}
+	}
+
+	frame := newRequest(unit, 15, nil)
+	SetDataWithRegisterAndNumberAndBytes(frame, start, uint16(len(values)), bytes)
+	return frame
+}
+
+// NewWriteMultipleRegistersRequest returns a Write Multiple Registers
+// (function 16) request.
+func NewWriteMultipleRegistersRequest(unit byte, start uint16, values []uint16) *TCPFrame {
+	frame := newRequest(unit, 16, nil)
+	SetDataWithRegisterAndNumberAndValues(frame, start, uint16(len(values)), values)
+	return frame
+}
@@ -0,0 +1,35 @@
+package mbserver
+
+import "testing"
+
+func TestRequests(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	for _, test := range []struct {
+		request *TCPFrame
+		expect  []byte
+	}{
+		{NewWriteSingleCoilRequest(255, 1, true), []byte{0, 0, 0, 0, 0, 6, 255, 5, 0, 1, 0xFF, 0}},
+		{NewWriteSingleRegisterRequest(255, 2, 0x1234), []byte{0, 0, 0, 0, 0, 6, 255, 6, 0, 2, 0x12, 0x34}},
+		{NewWriteMultipleCoilsRequest(255, 3, []bool{true, false, true, true, false, false, true, true, true}), []byte{0, 0, 0, 0, 0, 9, 255, 15, 0, 3, 0, 9, 2, 0xCD, 0x01}},
+		{NewWriteMultipleRegistersRequest(255, 4, []uint16{1, 2}), []byte{0, 0, 0, 0, 0, 11, 255, 16, 0, 4, 0, 2, 4, 0, 1, 0, 2}},
+		{NewReadCoilsRequest(255, 1, 3), []byte{0, 0, 0, 0, 0, 6, 255, 1, 0, 1, 0, 3}},
+		{NewReadDiscreteInputsRequest(255, 1, 3), []byte{0, 0, 0, 0, 0, 6, 255, 2, 0, 1, 0, 3}},
+		{NewReadHoldingRegistersRequest(255, 2, 1), []byte{0, 0, 0, 0, 0, 6, 255, 3, 0, 2, 0, 1}},
+		{NewReadInputRegistersRequest(255, 2, 1), []byte{0, 0, 0, 0, 0, 6, 255, 4, 0, 2, 0, 1}},
+	} {
+		got := test.request.Bytes()
+		if !isEqual(test.expect, got) {
+			t.Errorf("expected %v, got %v", test.expect, got)
+		}
+
+		req := Request{frame: test.request}
+		if exception := GetException(s.handle(&req)); exception != Success {
+			t.Errorf("function %d: expected Success, got %v", test.request.Function, exception.String())
+		}
+	}
+
+	if s.Coils[1] != 1 || s.HoldingRegisters[2] != 0x1234 || s.Coils[11] != 1 || s.HoldingRegisters[5] != 2 {
+		t.Errorf("expected the requests to write the server's memory")
+	}
+}
@@ -0,0 +1,104 @@
+package mbserver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Deferred is returned by a ContextFunctionHandler that writes its response
+// later, from another goroutine, with the ResponseWriter from its context.
+// The handler must make sure Write is eventually called, with an exception
+// if the response cannot be produced or the request's context is done. Until
+// then, the request's connection, Shutdown and Close wait for the response.
+var Deferred Exception = 0xFF
+
+// ResponseWriter writes the deferred response to a request.
+type ResponseWriter interface {
+	// Write sends the response holding data, or the exception when it is
+	// not Success, after the server's ResponseDelay or FunctionDelays. It
+	// blocks until the handler has returned and must be called exactly once.
+	Write(data []byte, exception *Exception) error
+}
+
+type responseWriter struct {
+	s         *Server
+	request   *Request
+	response  Framer
+	broadcast bool
+	done      func()
+
+	// returned is closed once the handler has returned.
+	returned chan struct{}
+	deferred bool
+
+	mu      sync.Mutex
+	written bool
+}
+
+// newResponseWriter takes over calling the request's done function until the
+// handler has returned.
+func newResponseWriter(s *Server, request *Request, response Framer, broadcast bool) *responseWriter {
+	w := &responseWriter{
+		s:         s,
+		request:   request,
+		response:  response,
+		broadcast: broadcast,
+		done:      request.done,
+		returned:  make(chan struct{}),
+	}
+	request.done = nil
+	return w
+}
+
+// context returns the request's context holding the writer.
+func (w *responseWriter) context() context.Context {
+	ctx := w.request.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, responseWriterKey, ResponseWriter(w))
+}
+
+// handled records the handler's exception and reports whether the response
+// was deferred to the writer. Otherwise the request's done function is
+// handed back.
+func (w *responseWriter) handled(exception *Exception) bool {
+	w.deferred = exception != nil && *exception == Deferred
+	if !w.deferred {
+		w.request.done = w.done
+	}
+	close(w.returned)
+	return w.deferred
+}
+
+func (w *responseWriter) Write(data []byte, exception *Exception) error {
+	<-w.returned
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.deferred {
+		return fmt.Errorf("response was not deferred")
+	}
+	if w.written {
+		return fmt.Errorf("response already written")
+	}
+	w.written = true
+
+	if w.done != nil {
+		defer w.done()
+	}
+
+	w.response.SetData(data)
+	response := w.s.finish(w.request, w.response, exception, w.broadcast)
+	if response == nil {
+		return nil
+	}
+
+	if delay := w.s.responseDelay(response.GetFunction()); delay > 0 {
+		time.Sleep(delay)
+	}
+	return w.s.writeResponse(w.request, response)
+}
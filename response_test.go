@@ -0,0 +1,96 @@
+package mbserver
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDeferredResponse(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.HoldingRegisters[1] = 0x0304
+
+	release := make(chan struct{})
+	errs := make(chan error, 2)
+	s.RegisterContextFunctionHandler(100, func(ctx context.Context, frame Framer) ([]byte, *Exception) {
+		w, ok := ResponseWriterFromContext(ctx)
+		if !ok {
+			return []byte{}, &SlaveDeviceFailure
+		}
+		go func() {
+			<-release
+			errs <- w.Write([]byte{1}, &Success)
+			errs <- w.Write([]byte{2}, &Success)
+		}()
+		return nil, &Deferred
+	})
+	err := s.ListenTCP("127.0.0.1:3350")
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:3350")
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	// The read is answered while the deferred response is pending.
+	conn.Write([]byte{0, 1, 0, 0, 0, 3, 255, 100, 0})
+	conn.Write([]byte{0, 2, 0, 0, 0, 6, 255, 3, 0, 1, 0, 1})
+	for i, expect := range [][]byte{
+		{0, 2, 0, 0, 0, 5, 255, 3, 2, 3, 4},
+		{0, 1, 0, 0, 0, 3, 255, 100, 1},
+	} {
+		if i == 1 {
+			close(release)
+		}
+		got := make([]byte, len(expect))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatalf("expected nil, got %v\n", err)
+		}
+		if !isEqual(expect, got) {
+			t.Errorf("expected %v, got %v", expect, got)
+		}
+	}
+
+	if err := <-errs; err != nil {
+		t.Errorf("expected nil, got %v\n", err)
+	}
+	if err := <-errs; err == nil {
+		t.Errorf("expected error not nil, got %v\n", err)
+	}
+}
+
+func TestDeferredResponseDelay(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.FunctionDelays = map[uint8]time.Duration{100: 50 * time.Millisecond}
+	s.RegisterContextFunctionHandler(100, func(ctx context.Context, frame Framer) ([]byte, *Exception) {
+		w, _ := ResponseWriterFromContext(ctx)
+		go w.Write([]byte{1}, &Success)
+		return nil, &Deferred
+	})
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.ServeConn(server)
+	client.SetDeadline(time.Now().Add(time.Second))
+
+	start := time.Now()
+	client.Write([]byte{0, 1, 0, 0, 0, 2, 255, 100})
+	expect := []byte{0, 1, 0, 0, 0, 3, 255, 100, 1}
+	got := make([]byte, len(expect))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected a delay of at least 50ms, got %v", elapsed)
+	}
+}
@@ -0,0 +1,82 @@
+package mbserver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/goburrow/serial"
+)
+
+// maxASCIIFrameLength is the longest legal Modbus ASCII frame including the
+// ':' start and CRLF end characters.
+const maxASCIIFrameLength = 513
+
+// ListenRTUASCII starts the Modbus server listening to a serial device using
+// Modbus ASCII framing.
+// For example:  err := s.ListenRTUASCII(&serial.Config{Address: "/dev/ttyUSB0"})
+func (s *Server) ListenRTUASCII(serialConfig *serial.Config) (err error) {
+	port, err := serial.Open(serialConfig)
+	if err != nil {
+		s.logf("failed to open %s: %v\n", serialConfig.Address, err)
+		return err
+	}
+	if err := s.register(func() { s.addPort(port) }); err != nil {
+		port.Close()
+		return err
+	}
+	s.startWorkers()
+	go s.acceptASCIIRequests(port)
+	return err
+}
+
+func (s *Server) acceptASCIIRequests(port serial.Port) {
+	defer s.wg.Done()
+
+	chunks := make(chan []byte)
+	go s.readSerial(port, chunks)
+
+	var packet []byte
+
+	for chunk := range chunks {
+		packet = append(packet, chunk...)
+
+		for {
+			// A ':' always marks the start of a new frame, so the frame ending
+			// at the next CRLF starts at the last ':' before it. Anything
+			// earlier is a truncated frame.
+			end := bytes.Index(packet, []byte("\r\n"))
+			limit := end
+			if end < 0 {
+				limit = len(packet)
+			}
+			if start := bytes.LastIndexByte(packet[:limit], ':'); start > 0 {
+				packet = packet[start:]
+				end -= start
+			}
+
+			if end < 0 {
+				if len(packet) > maxASCIIFrameLength {
+					err := fmt.Errorf("ASCII Frame error: no CRLF within %d bytes", maxASCIIFrameLength)
+					s.logf("bad serial frame error %v\n", err)
+					s.badFrame(packet, err)
+					packet = nil
+				}
+				break
+			}
+
+			raw := packet[:end+2]
+			packet = packet[end+2:]
+			frame, err := NewASCIIFrame(raw)
+			if err != nil {
+				s.logf("bad serial frame error %v\n", err)
+				s.badFrame(raw, err)
+				continue
+			}
+
+			request := &Request{ctx: context.Background(), conn: port, frame: frame, serial: true}
+
+			s.enqueue(request)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package mbserver
+
+import "testing"
+
+func TestAcceptASCIIRequests(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.HoldingRegisters[1] = 0x0304
+
+	port, w := newPipePort()
+	defer w.Close()
+
+	s.wg.Add(1)
+	go s.acceptASCIIRequests(port)
+
+	// Read holding register 1 from slave 1.
+	request := string((&ASCIIFrame{Address: 1, Function: 3, Data: []byte{0, 1, 0, 1}}).Bytes())
+	expect := string((&ASCIIFrame{Address: 1, Function: 3, Data: []byte{2, 3, 4}}).Bytes())
+
+	// A frame split across reads is reassembled.
+	w.Write([]byte(request[:4]))
+	w.Write([]byte(request[4:]))
+	if got := string(port.response(t)); expect != got {
+		t.Errorf("expected %q, got %q", expect, got)
+	}
+
+	// A bad frame is discarded, and frames in a single read are handled
+	// separately.
+	w.Write([]byte(":0103000100FF\r\n" + request + request))
+	for i := 0; i < 2; i++ {
+		if got := string(port.response(t)); expect != got {
+			t.Errorf("expected %q, got %q", expect, got)
+		}
+	}
+
+	// A truncated frame is discarded up to the frame following it.
+	w.Write([]byte(request[:7] + request))
+	if got := string(port.response(t)); expect != got {
+		t.Errorf("expected %q, got %q", expect, got)
+	}
+}
@@ -0,0 +1,40 @@
+package mbserver
+
+import (
+	"context"
+	"sync"
+)
+
+// ServeFrames handles the request frames received on in and sends their
+// responses on out, decoupling the server from net.Conn so it can be embedded
+// in other transports, e.g. Modbus frames carried over websockets. Requests
+// are handled like those of a TCP/IP connection, no response is sent for
+// dropped requests. ServeFrames returns once in is closed and
+// the responses to its requests have been sent, it does not close out. After
+// Close, it returns immediately.
+func (s *Server) ServeFrames(in <-chan Framer, out chan<- Framer) {
+	if err := s.register(func() {}); err != nil {
+		return
+	}
+	defer s.wg.Done()
+
+	s.startWorkers()
+
+	// Requests sent to the handler and not yet responded to.
+	var pending sync.WaitGroup
+	defer pending.Wait()
+
+	respond := func(response Framer) {
+		out <- response
+	}
+
+	for frame := range in {
+		pending.Add(1)
+		s.enqueue(&Request{
+			ctx:     context.Background(),
+			frame:   frame,
+			respond: respond,
+			done:    pending.Done,
+		})
+	}
+}
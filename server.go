@@ -3,34 +3,357 @@ package mbserver
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
 	"io"
 	"net"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/goburrow/serial"
 )
 
 // FunctionHandler defines a function type for defining custom Modbus
-// function code handlers.
+// function code handlers. A nil exception or a Success exception means the
+// data is sent as a normal response.
 type FunctionHandler func(*Server, Framer) ([]byte, *Exception)
 
 // ContextFunctionHandler defines a function type for defining external Modbus
-// function code handlers with a Context.
+// function code handlers with a Context. Exceptions are returned as for
+// FunctionHandler.
 type ContextFunctionHandler func(context.Context, Framer) ([]byte, *Exception)
 
+// RequestHook defines a function type called before a request is dispatched
+// to its function handler. Returning an exception rejects the request.
+type RequestHook func(ctx context.Context, frame Framer) *Exception
+
+// ResponseHook defines a function type called with each request and the
+// response that will be sent for it.
+type ResponseHook func(ctx context.Context, request, response Framer)
+
+// DefaultRoleOID is the client certificate extension holding the user's role
+// when Server.RoleOID is not set.
+var DefaultRoleOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 50316, 802, 1}
+
 // Server is a Modbus slave with allocated memory for discrete inputs, coils, etc.
+//
+// The built-in function handlers lock the server while accessing its memory,
+// so requests from several listeners can be served from the same memory.
+// Once the server is listening, accessing DiscreteInputs, Coils,
+// HoldingRegisters, InputRegisters or FileRecords directly is unsafe, hold
+// the lock returned by Lock or RLock or use the accessors, such as
+// SetHoldingRegisters, which take the lock themselves.
 type Server struct {
-	// Debug enables more verbose messaging.
-	Debug            bool
-	listeners        []net.Listener
-	ports            []serial.Port
-	requestChan      chan *Request
-	function         [256]FunctionHandler
+	// Debug enables more verbose messaging, including a hex dump of each
+	// request and response frame.
+	Debug bool
+	// Logger receives the server's log messages. When nil, messages are
+	// written by the standard log package.
+	Logger Logger
+	// ReadOnly rejects all write function codes with an IllegalFunction
+	// exception, regardless of the handler registered for them.
+	ReadOnly bool
+	// UnknownFunctionPolicy governs the response to requests for function
+	// codes without a handler, when no default handler is registered with
+	// RegisterDefaultHandler. By default they return an IllegalFunction
+	// exception.
+	UnknownFunctionPolicy UnknownFunctionPolicy
+	// UnitIDs, when not empty, limits the unit IDs (slave addresses) the
+	// server answers requests for. Note Modbus TCP clients commonly use unit
+	// ID 255.
+	UnitIDs []uint8
+	// DisableBroadcast handles unit ID 0 on serial lines like any other unit
+	// ID. By default, write requests to unit ID 0 are broadcasts, processed
+	// without sending a response, and read requests to unit ID 0 are dropped.
+	// TCP/IP clients commonly address the server itself with unit ID 0, it is
+	// never a broadcast there.
+	DisableBroadcast bool
+	// UnitIDException is returned for requests to other unit IDs, gateways
+	// return GatewayPathUnavailable. When nil, those requests are dropped
+	// without a response.
+	UnitIDException *Exception
+	// Authorize, when set, is called after the request hooks with the role
+	// from the client's TLS certificate, empty when the client has none.
+	// Returning false answers the request with an IllegalFunction exception.
+	Authorize func(role string, function uint8) bool
+	// FaultInjector, when set, is called after the request hooks for each
+	// request to this server's unit IDs. Returning an exception answers the
+	// request with it instead of calling the function handler, e.g. to return
+	// SlaveDeviceFailure for a fraction of requests.
+	FaultInjector func(frame Framer) *Exception
+	// ResponseDelay delays writing each response, simulating a slow device.
+	// The handler waits while delaying, so other requests are delayed too
+	// unless Workers is set.
+	ResponseDelay time.Duration
+	// FunctionDelays delays writing the responses to the function codes,
+	// overriding ResponseDelay.
+	FunctionDelays map[uint8]time.Duration
+	// OnRequest hooks are called in order before each request is dispatched,
+	// the first to return an exception rejects the request. The context holds
+	// the remote address, user and role of the request.
+	OnRequest []RequestHook
+	// OnResponse hooks are called in order with each response, including
+	// exception responses, before it is sent.
+	OnResponse []ResponseHook
+	// OnConnect and OnDisconnect, when set, are called when a TCP/IP client
+	// connects, after the TLS handshake, and when it disconnects, once the
+	// pending responses have been written and the connection closed. The
+	// context holds the remote address, user and role of the connection.
+	OnConnect    func(ctx context.Context)
+	OnDisconnect func(ctx context.Context)
+	// AccessLog, when set, is called with an entry for each request handled
+	// by a function handler.
+	AccessLog func(entry AccessLogEntry)
+	// OnBadFrame, when set, is called with each received frame that could not
+	// be parsed, such as serial frames failing their CRC or LRC check. Bad
+	// frames are also counted as bus communication errors.
+	OnBadFrame func(raw []byte, err error)
+	// OnWrite, when set, is called by the built-in write functions after the
+	// coils or holding registers starting at address of the unit have been
+	// updated. Coil values are 0 for off and 1 for on. It is called once the
+	// server is unlocked, so it can read the memory back with the accessors.
+	OnWrite func(unitID, code uint8, address uint16, values []uint16)
+	// MaxConnections limits the number of concurrent TCP/IP connections, new
+	// connections beyond the limit are closed. Zero means no limit.
+	MaxConnections int
+	// WriteTimeout closes TCP/IP connections that do not accept a response
+	// within the given duration, so a stalled client cannot block the
+	// handler. Zero means no timeout.
+	WriteTimeout time.Duration
+	// RequestsPerSecond limits the requests of each TCP/IP connection,
+	// requests beyond the limit get a SlaveDeviceBusy exception. Bursts of
+	// up to RequestsPerSecond requests are allowed. Zero means no limit.
+	RequestsPerSecond int
+	// Workers is the number of goroutines handling requests, it must be set
+	// before the server starts listening. Requests for the write function
+	// codes are still handled one at a time, but other requests, including
+	// slow custom handlers, no longer wait for each other. In exchange,
+	// responses to requests a client sends without waiting for each response
+	// may be written out of order, and hooks and handlers must be safe to call
+	// concurrently. Zero or one means a single goroutine.
+	Workers int
+	// OnQueueFull, when set, is called with each request received while the
+	// request queue is full, the handlers not keeping up with the requests.
+	// The queue holds the number of requests set by WithRequestQueueSize,
+	// without it any request arriving while the handlers are busy finds the
+	// queue full. Stats counts these requests as QueueFull.
+	OnQueueFull func(ctx context.Context, frame Framer)
+	// BusyWhenQueueFull answers requests received while the request queue is
+	// full with a SlaveDeviceBusy exception instead of waiting for the
+	// handlers.
+	BusyWhenQueueFull bool
+	// IdleTimeout closes TCP/IP connections that have not sent a request for
+	// the given duration. Zero means no timeout.
+	IdleTimeout time.Duration
+	// ListenConfig, when set, creates the TCP/IP and UDP listeners, e.g. with
+	// a Control function setting SO_REUSEPORT. By default they are created as
+	// by net.Listen and net.ListenPacket.
+	ListenConfig *net.ListenConfig
+	// KeepAlivePeriod sets the TCP keep-alive period of accepted TCP/IP
+	// connections, so peers lost behind NAT or firewalls are detected. Zero
+	// keeps the net package default and a negative value disables keep-alives.
+	KeepAlivePeriod time.Duration
+	// ResyncOnBadFrame discards the bytes of a TCP/IP stream up to the next
+	// plausible MBAP header, one with a protocol identifier of zero and the
+	// length of a valid frame. Without it, a corrupt header loses the stream's
+	// framing until the client reconnects.
+	ResyncOnBadFrame bool
+	// ClientAuth, when set, is the TLS client authentication mode used by
+	// ListenTLS. When nil, client certificates are required and verified, use
+	// tls.VerifyClientCertIfGiven to make them optional or tls.NoClientCert
+	// to not request them. Roles are only taken from verified client
+	// certificates.
+	ClientAuth *tls.ClientAuthType
+	// CRLFile, when set, is the path of a certificate revocation list signed
+	// by the CA, loaded by ListenTLS and ReloadTLS. Client certificates it
+	// revokes fail the handshake. OCSP checking can be added with
+	// ListenTLSWithConfig and a VerifyPeerCertificate function.
+	CRLFile string
+	// RoleOID is the client certificate extension holding the user's role.
+	// When nil, DefaultRoleOID is used.
+	RoleOID asn1.ObjectIdentifier
+	// RoleExtractor, when set, replaces the RoleOID lookup for sites whose
+	// role is held elsewhere in the client certificate. A nil role means the
+	// certificate does not carry a role.
+	RoleExtractor func(cert *x509.Certificate) (user string, role []byte)
+	// ServerID is returned by the Report Server ID function, it must be set
+	// before the server starts listening. The run indicator returned with it
+	// is set by SetRunIndicator.
+	ServerID []byte
+	// FileRecords holds the records, keyed by file number, accessed by the
+	// Read File Record and Write File Record functions.
+	FileRecords map[uint16][]uint16
+	// DeviceIdentification is returned by the Read Device Identification
+	// function.
+	DeviceIdentification DeviceIdentification
+	// DataFormat is the order of values spanning multiple registers used by
+	// the register helpers when they are passed DefaultOrder.
+	DataFormat ByteOrder
+
+	connections int32
+	busy        int32
+	// exceptionStatus is returned by the Read Exception Status function.
+	exceptionStatus uint32
+	// running is returned as the run indicator by the Report Server ID
+	// function.
+	running int32
+	// listenMu guards listeners, packetConns, closed and tlsConfigs.
+	listenMu    sync.Mutex
+	listeners   []net.Listener
+	packetConns []net.PacketConn
+	closed      bool
+	// tlsConfigs holds the configuration of each ListenTLS endpoint.
+	tlsConfigs  map[string]*atomic.Value
+	ports       []serial.Port
+	portsMu     sync.Mutex
+	requestChan chan *Request
+	function    [256]FunctionHandler
+
+	// MemoryBank is the memory of units without a bank of their own.
+	MemoryBank
+
+	handlers       [256]ContextFunctionHandler
+	defaultHandler ContextFunctionHandler
+	// meiHandlers are the function 43 handlers keyed by MEI type.
+	meiHandlers [256]ContextFunctionHandler
+
+	// handlersMu guards function, handlers, defaultHandler and meiHandlers.
+	handlersMu sync.RWMutex
+
+	units map[byte]*MemoryBank
+
+	fifoQueues map[uint16][]uint16
+
+	mu sync.RWMutex
+
+	// wg tracks the goroutines sending requests to the handler.
+	wg           sync.WaitGroup
+	connsMu      sync.Mutex
+	conns        map[net.Conn]struct{}
+	shuttingDown bool
+	shutdownOnce sync.Once
+
+	errs     chan error
+	errsOnce sync.Once
+
+	// statsMu guards stats, diagnosticRegister, diagnostics,
+	// commEventCounter and commEvents.
+	statsMu sync.Mutex
+	stats   Stats
+	// diagnosticRegister is returned by the Diagnostics function.
+	diagnosticRegister uint16
+	// diagnostics holds the counters returned by the Diagnostics function.
+	diagnostics DiagnosticCounters
+	// commEventCounter is returned by the Get Comm Event Counter function.
+	commEventCounter uint16
+	// commEvents is returned by the Get Comm Event Log function.
+	commEvents commEventLog
+
+	workersOnce sync.Once
+	writeMu     sync.Mutex
+	// requestQueueSize is the buffer of requestChan set by
+	// WithRequestQueueSize.
+	requestQueueSize int
+
+	// subscribersMu guards subscribers, the channels returned by Subscribe.
+	subscribersMu sync.Mutex
+	subscribers   map[chan WriteEvent]struct{}
+}
+
+// MemoryBank holds the memory of a Modbus unit.
+type MemoryBank struct {
 	DiscreteInputs   []byte
 	Coils            []byte
 	HoldingRegisters []uint16
 	InputRegisters   []uint16
+}
+
+// newMemoryBank allocates a memory bank with the given number of entries of
+// each type.
+func newMemoryBank(coils, discreteInputs, holdingRegisters, inputRegisters int) MemoryBank {
+	return MemoryBank{
+		DiscreteInputs:   make([]byte, discreteInputs),
+		Coils:            make([]byte, coils),
+		HoldingRegisters: make([]uint16, holdingRegisters),
+		InputRegisters:   make([]uint16, inputRegisters),
+	}
+}
+
+// UnknownFunctionPolicy is the response to requests for function codes
+// without a handler.
+type UnknownFunctionPolicy int
+
+const (
+	// UnknownFunctionException returns an IllegalFunction exception.
+	UnknownFunctionException UnknownFunctionPolicy = iota
+	// UnknownFunctionDrop sends no response.
+	UnknownFunctionDrop
+	// UnknownFunctionClose sends no response and closes the TCP/IP
+	// connection. Requests received on a serial line or over UDP are
+	// dropped.
+	UnknownFunctionClose
+)
+
+// DiagnosticCounters are the counters returned by the Diagnostics function.
+// The server counts the messages it handles and the exceptions it returns,
+// the application can maintain the remaining counters with
+// UpdateDiagnostics.
+type DiagnosticCounters struct {
+	BusMessage            uint16
+	BusCommunicationError uint16
+	BusExceptionError     uint16
+	ServerMessage         uint16
+	ServerNoResponse      uint16
+	ServerNAK             uint16
+	ServerBusy            uint16
+	BusCharacterOverrun   uint16
+}
+
+// DeviceIdentification holds the objects returned by the Read Device
+// Identification function. The basic objects are always returned, the
+// regular objects only when they are not empty.
+type DeviceIdentification struct {
+	VendorName          string
+	ProductCode         string
+	MajorMinorRevision  string
+	VendorURL           string
+	ProductName         string
+	ModelName           string
+	UserApplicationName string
+	// Extended holds the private objects, keyed by object ID 0x80 to 0xFF.
+	Extended map[byte]string
+}
 
-	handlers [256]ContextFunctionHandler
+type deviceObject struct {
+	id    byte
+	value string
+}
+
+// objects returns the device identification objects ordered by object ID.
+func (d *DeviceIdentification) objects() []deviceObject {
+	objects := []deviceObject{
+		{0x00, d.VendorName},
+		{0x01, d.ProductCode},
+		{0x02, d.MajorMinorRevision},
+	}
+
+	for i, value := range []string{d.VendorURL, d.ProductName, d.ModelName, d.UserApplicationName} {
+		if value != "" {
+			objects = append(objects, deviceObject{byte(0x03 + i), value})
+		}
+	}
+
+	for id := 0x80; id <= 0xFF; id++ {
+		if value, ok := d.Extended[byte(id)]; ok {
+			objects = append(objects, deviceObject{byte(id), value})
+		}
+	}
+
+	return objects
 }
 
 // Request contains the connection and Modbus frame.
@@ -38,9 +361,20 @@ type Request struct {
 	ctx   context.Context
 	conn  io.ReadWriteCloser
 	frame Framer
+	// serial is set for requests received on a serial line.
+	serial bool
+	// busy is set for requests beyond the connection's rate limit.
+	busy bool
+	// done, if set, is called once the response has been written.
+	done func()
+	// respond, if set, receives the response instead of conn.
+	respond func(response Framer)
 }
 
-// NewServer creates a new Modbus server (slave).
+// NewServer creates a new Modbus server (slave) without memory or function
+// handlers, requests return an IllegalFunction exception until handlers are
+// registered. Use NewServerWithDefaults, or call EnableDefaults, for a server
+// with the default function handlers and memory.
 func NewServer() *Server {
 	s := &Server{
 		requestChan: make(chan *Request),
@@ -53,23 +387,7 @@ func NewServer() *Server {
 // NewServer creates a new Modbus server (slave) with default function handlers
 // and registers.
 func NewServerWithDefaults() *Server {
-	s := &Server{}
-
-	// Allocate Modbus memory maps.
-	s.DiscreteInputs = make([]byte, 65536)
-	s.Coils = make([]byte, 65536)
-	s.HoldingRegisters = make([]uint16, 65536)
-	s.InputRegisters = make([]uint16, 65536)
-
-	// Add default functions.
-	s.function[1] = ReadCoils
-	s.function[2] = ReadDiscreteInputs
-	s.function[3] = ReadHoldingRegisters
-	s.function[4] = ReadInputRegisters
-	s.function[5] = WriteSingleCoil
-	s.function[6] = WriteHoldingRegister
-	s.function[15] = WriteMultipleCoils
-	s.function[16] = WriteHoldingRegisters
+	s := newServerWithDefaults()
 
 	s.requestChan = make(chan *Request)
 	go s.handler()
@@ -77,55 +395,699 @@ func NewServerWithDefaults() *Server {
 	return s
 }
 
+// newServerWithDefaults creates a server with default function handlers and
+// registers, without starting its handler.
+func newServerWithDefaults() *Server {
+	s := &Server{}
+	s.EnableDefaults()
+
+	return s
+}
+
+// defaultFunctions are the function handlers registered by EnableDefaults.
+var defaultFunctions = map[uint8]FunctionHandler{
+	1:  ReadCoils,
+	2:  ReadDiscreteInputs,
+	3:  ReadHoldingRegisters,
+	4:  ReadInputRegisters,
+	5:  WriteSingleCoil,
+	6:  WriteHoldingRegister,
+	7:  ReadExceptionStatus,
+	8:  Diagnostics,
+	11: GetCommEventCounter,
+	12: GetCommEventLog,
+	15: WriteMultipleCoils,
+	16: WriteHoldingRegisters,
+	17: ReportServerID,
+	20: ReadFileRecord,
+	21: WriteFileRecord,
+	22: MaskWriteRegister,
+	23: ReadWriteMultipleRegisters,
+	24: ReadFIFOQueue,
+	43: ReadDeviceIdentification,
+}
+
+// EnableDefaults allocates 65536 of each memory type, unless memory has been
+// allocated, and registers the default function handlers for the Modbus
+// functions without a handler. It makes a server created by NewServer, which
+// has neither, behave like one created by NewServerWithDefaults.
+func (s *Server) EnableDefaults() {
+	s.Lock()
+	if s.DiscreteInputs == nil && s.Coils == nil && s.HoldingRegisters == nil && s.InputRegisters == nil {
+		s.MemoryBank = newMemoryBank(65536, 65536, 65536, 65536)
+	}
+	s.Unlock()
+
+	s.handlersMu.Lock()
+	defer s.handlersMu.Unlock()
+
+	for code, handler := range defaultFunctions {
+		if s.function[code] == nil {
+			s.function[code] = handler
+		}
+	}
+}
+
 // RegisterFunctionHandler override the default behavior for a given Modbus function.
 func (s *Server) RegisterFunctionHandler(code uint8, handler FunctionHandler) {
+	s.handlersMu.Lock()
+	defer s.handlersMu.Unlock()
+
 	s.function[code] = handler
 }
 
 // RegisterContextFunctionHandler registers a new external ContextFunctionHandler.
 func (s *Server) RegisterContextFunctionHandler(code uint8, handler ContextFunctionHandler) {
+	s.handlersMu.Lock()
+	defer s.handlersMu.Unlock()
+
 	s.handlers[code] = handler
 }
 
+// RegisterDefaultHandler registers a ContextFunctionHandler for the Modbus
+// functions without a handler of their own, e.g. to forward them with a
+// proxy handler or log them. A nil handler removes it. It is safe to call
+// while the server is listening.
+func (s *Server) RegisterDefaultHandler(handler ContextFunctionHandler) {
+	s.handlersMu.Lock()
+	defer s.handlersMu.Unlock()
+
+	s.defaultHandler = handler
+}
+
+// RegisterMEIHandler registers a ContextFunctionHandler for the requests of
+// function 43, Encapsulated Interface Transport, with the MEI type, e.g. 0x0D
+// for CANopen. It takes precedence over the handlers of function 43, which
+// receive the requests of MEI types without a handler, by default
+// ReadDeviceIdentification for MEI type 0x0E. A nil handler removes it. It is
+// safe to call while the server is listening.
+func (s *Server) RegisterMEIHandler(meiType byte, handler ContextFunctionHandler) {
+	s.handlersMu.Lock()
+	defer s.handlersMu.Unlock()
+
+	s.meiHandlers[meiType] = handler
+}
+
+// DeregisterFunctionHandler removes the FunctionHandler for a Modbus function,
+// including a default one. Requests for the function then return an
+// IllegalFunction exception, unless a ContextFunctionHandler or a default
+// handler is registered. It is safe to call while the server is listening.
+func (s *Server) DeregisterFunctionHandler(code uint8) {
+	s.RegisterFunctionHandler(code, nil)
+}
+
+// DeregisterContextFunctionHandler removes the ContextFunctionHandler for a
+// Modbus function. It is safe to call while the server is listening.
+func (s *Server) DeregisterContextFunctionHandler(code uint8) {
+	s.RegisterContextFunctionHandler(code, nil)
+}
+
+// HasHandler reports whether a FunctionHandler or a ContextFunctionHandler is
+// registered for a Modbus function. The default handler registered with
+// RegisterDefaultHandler is not considered.
+func (s *Server) HasHandler(code uint8) bool {
+	s.handlersMu.RLock()
+	defer s.handlersMu.RUnlock()
+
+	return s.function[code] != nil || s.handlers[code] != nil
+}
+
+// functionHandlers returns the handlers registered for the frame's function,
+// or its MEI type for function 43, falling back to the default handler.
+func (s *Server) functionHandlers(frame Framer) (FunctionHandler, ContextFunctionHandler) {
+	s.handlersMu.RLock()
+	defer s.handlersMu.RUnlock()
+
+	code := frame.GetFunction()
+	if data := frame.GetData(); code == 43 && len(data) > 0 && s.meiHandlers[data[0]] != nil {
+		return nil, s.meiHandlers[data[0]]
+	}
+
+	if s.function[code] == nil && s.handlers[code] == nil {
+		return nil, s.defaultHandler
+	}
+	return s.function[code], s.handlers[code]
+}
+
+// SetBusy sets whether the server answers all requests with a SlaveDeviceBusy
+// exception, telling clients to retry later, e.g. while the application is
+// reconfiguring. It is safe to call while the server is handling requests.
+func (s *Server) SetBusy(busy bool) {
+	var value int32
+	if busy {
+		value = 1
+	}
+	atomic.StoreInt32(&s.busy, value)
+}
+
+// Busy reports whether the server answers all requests with a SlaveDeviceBusy
+// exception.
+func (s *Server) Busy() bool {
+	return atomic.LoadInt32(&s.busy) != 0
+}
+
+// SetExceptionStatus sets the exception status byte returned by the Read
+// Exception Status function. It is safe to call while the server is handling
+// requests.
+func (s *Server) SetExceptionStatus(status byte) {
+	atomic.StoreUint32(&s.exceptionStatus, uint32(status))
+}
+
+// ExceptionStatus returns the exception status byte returned by the Read
+// Exception Status function.
+func (s *Server) ExceptionStatus() byte {
+	return byte(atomic.LoadUint32(&s.exceptionStatus))
+}
+
+// SetRunIndicator sets whether the Report Server ID function reports the
+// server as running. It is safe to call while the server is handling
+// requests.
+func (s *Server) SetRunIndicator(on bool) {
+	var value int32
+	if on {
+		value = 1
+	}
+	atomic.StoreInt32(&s.running, value)
+}
+
+// RunIndicator reports whether the Report Server ID function reports the
+// server as running.
+func (s *Server) RunIndicator() bool {
+	return atomic.LoadInt32(&s.running) != 0
+}
+
+// Lock locks the server memory for writing.
+func (s *Server) Lock() {
+	s.mu.Lock()
+}
+
+// Unlock unlocks the server memory for writing.
+func (s *Server) Unlock() {
+	s.mu.Unlock()
+}
+
+// RLock locks the server memory for reading.
+func (s *Server) RLock() {
+	s.mu.RLock()
+}
+
+// RUnlock unlocks the server memory for reading.
+func (s *Server) RUnlock() {
+	s.mu.RUnlock()
+}
+
+// AllocateMemory replaces the server's memory with zeroed memory holding the
+// given number of coils, discrete inputs, holding registers and input
+// registers. Requests beyond them return an IllegalDataAddress exception.
+// NewServerWithDefaults allocates 65536 of each.
+func (s *Server) AllocateMemory(coils, discreteInputs, holdingRegisters, inputRegisters int) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.MemoryBank = newMemoryBank(coils, discreteInputs, holdingRegisters, inputRegisters)
+}
+
+// AliasInputRegisters makes the input registers a view of count holding
+// registers starting at start, input register 0 being holding register
+// start. Writes to the holding registers are visible in the input registers
+// immediately. Calling AllocateMemory ends the alias.
+func (s *Server) AliasInputRegisters(start, count uint16) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := checkRange("holding registers", len(s.HoldingRegisters), start, int(count)); err != nil {
+		return err
+	}
+	end := int(start) + int(count)
+	s.InputRegisters = s.HoldingRegisters[start:end:end]
+	return nil
+}
+
+// AddUnit allocates a memory bank for the unit ID, sized like the server's own
+// memory, and returns it. Requests for the unit ID are served from the bank
+// instead of the server's own memory. Once the server is listening, the bank
+// must be accessed while holding the server's lock.
+func (s *Server) AddUnit(id byte) *MemoryBank {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.units == nil {
+		s.units = make(map[byte]*MemoryBank)
+	}
+	bank := newMemoryBank(len(s.Coils), len(s.DiscreteInputs), len(s.HoldingRegisters), len(s.InputRegisters))
+	s.units[id] = &bank
+	return &bank
+}
+
+// bank returns the memory bank for the frame's unit ID. The caller must hold
+// the server's lock.
+func (s *Server) bank(frame Framer) *MemoryBank {
+	if bank, ok := s.units[frame.GetUnitID()]; ok {
+		return bank
+	}
+	return &s.MemoryBank
+}
+
+// notifyWrite calls OnWrite, if set, for values written at address by the
+// frame's function and publishes the write to the subscribers. The caller
+// must have released the server's lock, so OnWrite can use the accessors.
+func (s *Server) notifyWrite(frame Framer, address int, values []uint16) {
+	if s.OnWrite != nil {
+		s.OnWrite(frame.GetUnitID(), frame.GetFunction(), uint16(address), values)
+	}
+	s.publish(frame.GetUnitID(), frame.GetFunction(), uint16(address), values)
+}
+
+// SetFIFOQueue sets the queue returned by the Read FIFO Queue function for the
+// given FIFO pointer address. The Modbus spec limits a queue to 31 values.
+func (s *Server) SetFIFOQueue(address uint16, values []uint16) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.fifoQueues == nil {
+		s.fifoQueues = make(map[uint16][]uint16)
+	}
+	s.fifoQueues[address] = append([]uint16{}, values...)
+}
+
+// handle returns the response to the request, or nil if no response should
+// be sent.
 func (s *Server) handle(request *Request) Framer {
 	var exception *Exception
 	var data []byte
 
 	response := request.frame.Copy()
 
+	s.count(&s.diagnostics.BusMessage)
+
 	function := request.frame.GetFunction()
-	if s.function[function] != nil {
-		data, exception = s.function[function](s, request.frame)
+
+	// Broadcasts are addressed to every unit and are never answered.
+	broadcast := request.serial && !s.DisableBroadcast && request.frame.GetUnitID() == 0
+	if broadcast {
+		s.logCommEvent(receiveEvent | receiveBroadcast)
+	} else {
+		s.logCommEvent(receiveEvent)
+	}
+	if broadcast && !isWriteFunction(function) {
+		s.logf("broadcast of read function %d dropped\n", function)
+		s.count(&s.diagnostics.ServerNoResponse)
+		return nil
+	}
+
+	if !broadcast && !s.acceptsUnitID(request.frame.GetUnitID()) {
+		if s.UnitIDException == nil {
+			return nil
+		}
+		response.SetException(s.UnitIDException)
+		return response
+	}
+
+	s.count(&s.diagnostics.ServerMessage)
+
+	if request.busy || s.Busy() {
+		exception = &SlaveDeviceBusy
+		s.count(&s.diagnostics.ServerBusy)
+	} else {
+		for _, hook := range s.OnRequest {
+			if exception = hook(request.ctx, request.frame); isException(exception) {
+				break
+			}
+		}
+		if !isException(exception) && s.Authorize != nil && !s.authorized(request, function) {
+			exception = &IllegalFunction
+		}
+		if !isException(exception) && s.FaultInjector != nil {
+			exception = s.FaultInjector(request.frame)
+		}
+	}
+
+	if !isException(exception) && s.ReadOnly && isWriteFunction(function) {
+		exception = &IllegalFunction
+	}
+
+	// Writes are serialized when several workers handle requests. Rejected
+	// writes are answered without waiting for the write in progress.
+	if !isException(exception) && isWriteFunction(function) {
+		s.writeMu.Lock()
+		defer s.writeMu.Unlock()
+	}
+
+	handler, contextHandler := s.functionHandlers(request.frame)
+
+	if isException(exception) {
+		// Rejected as busy, by a request hook, as unauthorized, by an
+		// injected fault or as a write to a read-only server.
+	} else if handler != nil {
+		data, exception = s.call(function, func() ([]byte, *Exception) {
+			return handler(s, request.frame)
+		})
 		response.SetData(data)
-	} else if s.handlers[function] != nil {
-		data, exception = s.handlers[function](request.ctx, request.frame)
+	} else if contextHandler != nil {
+		writer := newResponseWriter(s, request, response, broadcast)
+		data, exception = s.call(function, func() ([]byte, *Exception) {
+			return contextHandler(writer.context(), request.frame)
+		})
+		if writer.handled(exception) {
+			return nil
+		}
 		response.SetData(data)
+	} else if s.UnknownFunctionPolicy != UnknownFunctionException {
+		s.dropUnknownFunction(request)
+		return nil
 	} else {
 		exception = &IllegalFunction
 	}
 
-	if exception != &Success {
+	return s.finish(request, response, exception, broadcast)
+}
+
+// dropUnknownFunction drops a request for a function code without a handler,
+// closing its connection if the policy is UnknownFunctionClose.
+func (s *Server) dropUnknownFunction(request *Request) {
+	function := request.frame.GetFunction()
+	s.count(&s.diagnostics.ServerNoResponse)
+	s.countRequest(function, true)
+
+	// Serial ports are shared by all clients on the line and are never
+	// closed.
+	if conn, ok := request.conn.(net.Conn); ok && s.UnknownFunctionPolicy == UnknownFunctionClose {
+		s.logf("closing connection from %v: unknown function %d\n", conn.RemoteAddr(), function)
+		conn.Close()
+		return
+	}
+	s.logf("request for unknown function %d dropped\n", function)
+}
+
+// call calls a function handler, turning a panic into a SlaveDeviceFailure
+// exception so the server keeps serving other requests.
+func (s *Server) call(function uint8, handler func() ([]byte, *Exception)) (data []byte, exception *Exception) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.logf("function %d handler panic: %v\n%s", function, r, debug.Stack())
+			data, exception = []byte{}, &SlaveDeviceFailure
+		}
+	}()
+
+	return handler()
+}
+
+// finish completes the response to the request with the exception, it
+// returns nil if no response should be sent.
+func (s *Server) finish(request *Request, response Framer, exception *Exception, broadcast bool) Framer {
+	if isException(exception) {
 		response.SetException(exception)
+		s.count(&s.diagnostics.BusExceptionError)
+	}
+	s.countRequest(request.frame.GetFunction(), isException(exception))
+
+	// Get Comm Event Counter requests are not counted as events.
+	if !isException(exception) && !broadcast && request.frame.GetFunction() != 11 {
+		s.count(&s.commEventCounter)
+	}
+
+	if broadcast {
+		s.count(&s.diagnostics.ServerNoResponse)
+		s.accessLog(request, nil)
+		return nil
+	}
+	s.logCommEvent(sendCommEvent(exception))
+	s.accessLog(request, response)
+
+	for _, hook := range s.OnResponse {
+		hook(request.ctx, request.frame, response)
 	}
 
 	return response
 }
 
+// authorized reports whether Authorize allows the role of the request's
+// client to use the function.
+func (s *Server) authorized(request *Request, function uint8) bool {
+	var role string
+	if request.ctx != nil {
+		role, _ = RoleFromContext(request.ctx)
+	}
+	return s.Authorize(role, function)
+}
+
+// isException reports whether a handler returned an exception. Handlers
+// return nil or a pointer to a Success value for success.
+func isException(exception *Exception) bool {
+	return exception != nil && *exception != Success
+}
+
+// acceptsUnitID reports whether the server answers requests for the unit ID.
+func (s *Server) acceptsUnitID(unitID uint8) bool {
+	if len(s.UnitIDs) == 0 {
+		return true
+	}
+	for _, id := range s.UnitIDs {
+		if id == unitID {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFunctions are the Modbus function codes that modify server memory.
+var writeFunctions = map[uint8]bool{
+	5:  true, // Write Single Coil
+	6:  true, // Write Single Register
+	15: true, // Write Multiple Coils
+	16: true, // Write Multiple Registers
+	21: true, // Write File Record
+	22: true, // Mask Write Register
+	23: true, // Read/Write Multiple Registers
+}
+
+func isWriteFunction(function uint8) bool {
+	return writeFunctions[function]
+}
+
 // All requests are handled synchronously to prevent modbus memory corruption.
 func (s *Server) handler() {
-	for {
-		request := <-s.requestChan
-		response := s.handle(request)
-		request.conn.Write(response.Bytes())
+	for request := range s.requestChan {
+		s.serve(request)
 	}
 }
 
-// Close stops listening to TCP/IP ports and closes serial ports.
+// serve handles a request and writes its response.
+func (s *Server) serve(request *Request) {
+	s.dumpFrame("request", request.frame)
+	response := s.handle(request)
+	if response != nil {
+		if delay := s.responseDelay(response.GetFunction()); delay > 0 {
+			time.Sleep(delay)
+		}
+		s.writeResponse(request, response)
+	}
+	if request.done != nil {
+		request.done()
+	}
+}
+
+// enqueue sends a request to the handlers. While the request queue is full,
+// the request is counted and passed to OnQueueFull, then answered with a
+// SlaveDeviceBusy exception if BusyWhenQueueFull is set, or queued once the
+// handlers catch up.
+func (s *Server) enqueue(request *Request) {
+	select {
+	case s.requestChan <- request:
+		return
+	default:
+	}
+
+	s.statsMu.Lock()
+	s.stats.QueueFull++
+	s.statsMu.Unlock()
+
+	if s.OnQueueFull != nil {
+		s.OnQueueFull(request.ctx, request.frame)
+	}
+
+	if s.BusyWhenQueueFull {
+		request.busy = true
+		s.serve(request)
+		return
+	}
+	s.requestChan <- request
+}
+
+// writeResponse writes the response to the request's connection, or passes it
+// to the request's respond function. TCP/IP connections not accepting the
+// response within WriteTimeout are closed.
+func (s *Server) writeResponse(request *Request, response Framer) error {
+	s.dumpFrame("response", response)
+
+	if request.respond != nil {
+		request.respond(response)
+		return nil
+	}
+
+	conn, ok := request.conn.(net.Conn)
+	if ok && s.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+	}
+
+	_, err := request.conn.Write(response.Bytes())
+	if err != nil {
+		s.logf("write error %v\n", err)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			request.conn.Close()
+		}
+	}
+	return err
+}
+
+// responseDelay returns the delay before writing a response to the function.
+func (s *Server) responseDelay(function uint8) time.Duration {
+	if delay, ok := s.FunctionDelays[function&0x7F]; ok {
+		return delay
+	}
+	return s.ResponseDelay
+}
+
+// startWorkers starts the request handlers beyond the first, once Workers is
+// set. It is called when the server starts listening or serving a connection
+// or frames.
+func (s *Server) startWorkers() {
+	s.workersOnce.Do(func() {
+		for i := 1; i < s.Workers; i++ {
+			go s.handler()
+		}
+	})
+}
+
+// badFrame counts and reports a frame that could not be parsed.
+func (s *Server) badFrame(raw []byte, err error) {
+	s.count(&s.diagnostics.BusCommunicationError)
+	s.logCommEvent(receiveEvent | receiveCommunicationError)
+	if s.OnBadFrame != nil {
+		s.OnBadFrame(raw, err)
+	}
+}
+
+// count increments a diagnostic counter.
+func (s *Server) count(counter *uint16) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	*counter++
+}
+
+// ErrServerClosed is returned by the Listen methods and Serve after Close.
+var ErrServerClosed = errors.New("server closed")
+
+// Close stops listening to TCP/IP and UDP ports and closes serial ports. The
+// server's handlers exit once the TCP/IP connections still being served are
+// closed. Listening again returns ErrServerClosed. Calling Close more than
+// once has no effect.
 func (s *Server) Close() {
-	for _, listen := range s.listeners {
+	s.listenMu.Lock()
+	if s.closed {
+		s.listenMu.Unlock()
+		return
+	}
+	s.closed = true
+	listeners, packetConns := s.listeners, s.packetConns
+	s.listenMu.Unlock()
+
+	for _, listen := range listeners {
 		listen.Close()
 	}
-	for _, port := range s.ports {
+	for _, conn := range packetConns {
+		conn.Close()
+	}
+
+	s.portsMu.Lock()
+	ports := s.ports
+	s.ports = nil
+	s.portsMu.Unlock()
+
+	for _, port := range ports {
 		port.Close()
 	}
+
+	go func() {
+		s.wg.Wait()
+		s.closeHandlers()
+	}()
+}
+
+// register runs add, which records a listener or port for Close, and adds a
+// goroutine serving it to wg. It returns ErrServerClosed once the server is
+// closed.
+func (s *Server) register(add func()) error {
+	s.listenMu.Lock()
+	defer s.listenMu.Unlock()
+
+	if s.closed {
+		return ErrServerClosed
+	}
+	add()
+	s.wg.Add(1)
+	return nil
+}
+
+// closeHandlers stops the handlers once no goroutine sends them requests.
+func (s *Server) closeHandlers() {
+	s.shutdownOnce.Do(func() {
+		close(s.requestChan)
+	})
+}
+
+// Errors returns a channel receiving the errors that stop a listener, such as
+// a failing Accept. Stopping a listener with Close or Shutdown is not
+// reported. Errors are dropped while the channel's buffer is full.
+func (s *Server) Errors() <-chan error {
+	return s.errorChan()
+}
+
+func (s *Server) errorChan() chan error {
+	s.errsOnce.Do(func() {
+		s.errs = make(chan error, 16)
+	})
+	return s.errs
+}
+
+// reportError sends a listener's fatal error to the Errors channel.
+func (s *Server) reportError(err error) {
+	select {
+	case s.errorChan() <- err:
+	default:
+	}
+}
+
+// Shutdown gracefully stops the server. It stops listening, lets each
+// connection finish the request it is reading or waiting on, and returns once
+// all responses have been written. If the context expires first, Shutdown
+// returns the context's error and the remaining connections are left to
+// finish on their own.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.Close()
+
+	// Interrupt blocked reads, connections exit after their current request.
+	s.connsMu.Lock()
+	s.shuttingDown = true
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.connsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	s.closeHandlers()
+
+	return nil
 }
@@ -1,6 +1,13 @@
 package mbserver
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
 	"testing"
 	"time"
 
@@ -43,9 +50,314 @@ func TestUnsupportedFunction(t *testing.T) {
 	}
 }
 
+func TestDeregisterFunctionHandler(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.RegisterContextFunctionHandler(100, func(ctx context.Context, frame Framer) ([]byte, *Exception) {
+		return []byte{}, &Success
+	})
+
+	var frame TCPFrame
+	frame.Device = 255
+	frame.Function = 7
+	var req Request
+	req.frame = &frame
+
+	s.DeregisterFunctionHandler(7)
+	if exception := GetException(s.handle(&req)); exception != IllegalFunction {
+		t.Errorf("expected IllegalFunction, got %v", exception.String())
+	}
+
+	frame.Function = 100
+	if exception := GetException(s.handle(&req)); exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+	}
+	s.DeregisterContextFunctionHandler(100)
+	if exception := GetException(s.handle(&req)); exception != IllegalFunction {
+		t.Errorf("expected IllegalFunction, got %v", exception.String())
+	}
+
+	// A function can be registered again.
+	s.RegisterFunctionHandler(7, ReadExceptionStatus)
+	frame.Function = 7
+	if exception := GetException(s.handle(&req)); exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+	}
+}
+
+func TestServeFrames(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.HoldingRegisters[1] = 0x0304
+
+	in := make(chan Framer)
+	out := make(chan Framer, 1)
+	served := make(chan struct{})
+	go func() {
+		s.ServeFrames(in, out)
+		close(served)
+	}()
+
+	in <- NewReadHoldingRegistersRequest(1, 1, 1)
+	select {
+	case response := <-out:
+		expect := []byte{0, 0, 0, 0, 0, 5, 1, 3, 2, 3, 4}
+		got := response.Bytes()
+		if !isEqual(expect, got) {
+			t.Errorf("expected %v, got %v", expect, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for the response")
+	}
+
+	// Dropped requests get no response.
+	s.UnknownFunctionPolicy = UnknownFunctionDrop
+	in <- newRequest(1, 100, []byte{0})
+	close(in)
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for ServeFrames to return")
+	}
+	if len(out) != 0 {
+		t.Errorf("expected no response, got %v", <-out)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	s := NewServerWithOptions(WithRequestQueueSize(1))
+	s.BusyWhenQueueFull = true
+	full := make(chan uint8, 1)
+	s.OnQueueFull = func(ctx context.Context, frame Framer) {
+		full <- frame.GetFunction()
+	}
+
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	s.RegisterContextFunctionHandler(100, func(ctx context.Context, frame Framer) ([]byte, *Exception) {
+		started <- struct{}{}
+		<-release
+		return []byte{}, &Success
+	})
+
+	responses := make(chan Framer, 3)
+	enqueue := func(frame Framer) {
+		s.enqueue(&Request{
+			ctx:     context.Background(),
+			frame:   frame,
+			respond: func(response Framer) { responses <- response },
+		})
+	}
+
+	// The handler is busy with the first request and the second fills the
+	// queue.
+	enqueue(newRequest(1, 100, []byte{0}))
+	<-started
+	enqueue(newRequest(1, 100, []byte{0}))
+
+	enqueue(NewReadHoldingRegistersRequest(1, 0, 1))
+	if function := <-full; function != 3 {
+		t.Errorf("expected %v, got %v", 3, function)
+	}
+	if exception := GetException(<-responses); exception != SlaveDeviceBusy {
+		t.Errorf("expected SlaveDeviceBusy, got %v", exception.String())
+	}
+	if stats := s.Stats(); stats.QueueFull != 1 {
+		t.Errorf("expected %v, got %v", 1, stats.QueueFull)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if exception := GetException(<-responses); exception != Success {
+			t.Errorf("expected Success, got %v", exception.String())
+		}
+	}
+}
+
+func TestQueueFullWrite(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s.RegisterFunctionHandler(6, func(s *Server, frame Framer) ([]byte, *Exception) {
+		close(started)
+		<-release
+		return frame.GetData(), &Success
+	})
+	defer close(release)
+
+	responses := make(chan Framer, 2)
+	enqueue := func(frame Framer) {
+		s.enqueue(&Request{
+			ctx:     context.Background(),
+			frame:   frame,
+			respond: func(response Framer) { responses <- response },
+		})
+	}
+
+	// A write rejected as busy does not wait for the write in progress.
+	enqueue(NewWriteSingleRegisterRequest(1, 0, 1))
+	<-started
+	s.BusyWhenQueueFull = true
+	go enqueue(NewWriteSingleRegisterRequest(1, 0, 2))
+	select {
+	case response := <-responses:
+		if exception := GetException(response); exception != SlaveDeviceBusy {
+			t.Errorf("expected SlaveDeviceBusy, got %v", exception.String())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for the busy response")
+	}
+}
+
+func TestRegisterDefaultHandler(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.UnknownFunctionPolicy = UnknownFunctionDrop
+	s.RegisterDefaultHandler(func(ctx context.Context, frame Framer) ([]byte, *Exception) {
+		return []byte{frame.GetFunction()}, &Success
+	})
+
+	var frame TCPFrame
+	frame.Device = 255
+	var req Request
+	req.frame = &frame
+
+	for _, function := range []uint8{100, 101} {
+		frame.Function = function
+		expect := []byte{function}
+		got := s.handle(&req).GetData()
+		if !isEqual(expect, got) {
+			t.Errorf("expected %v, got %v", expect, got)
+		}
+	}
+
+	// Specific handlers take precedence.
+	frame.Function = 3
+	SetDataWithRegisterAndNumber(&frame, 0, 1)
+	expect := []byte{2, 0, 0}
+	got := s.handle(&req).GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	// Without it, the unknown function policy applies.
+	s.RegisterDefaultHandler(nil)
+	frame.Function = 100
+	if response := s.handle(&req); response != nil {
+		t.Errorf("expected nil, got %v", response)
+	}
+}
+
+func TestHasHandler(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.RegisterDefaultHandler(func(ctx context.Context, frame Framer) ([]byte, *Exception) {
+		return []byte{}, &Success
+	})
+
+	var got []int
+	for code := 0; code < 256; code++ {
+		if s.HasHandler(uint8(code)) {
+			got = append(got, code)
+		}
+	}
+	expect := []int{1, 2, 3, 4, 5, 6, 7, 8, 11, 12, 15, 16, 17, 20, 21, 22, 23, 24, 43}
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	s.RegisterContextFunctionHandler(100, func(ctx context.Context, frame Framer) ([]byte, *Exception) {
+		return []byte{}, &Success
+	})
+	s.DeregisterFunctionHandler(3)
+	if !s.HasHandler(100) || s.HasHandler(3) {
+		t.Errorf("expected a handler for 100 and none for 3")
+	}
+}
+
+func TestRegisterMEIHandler(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.RegisterMEIHandler(0x0D, func(ctx context.Context, frame Framer) ([]byte, *Exception) {
+		return frame.GetData(), &Success
+	})
+
+	var frame TCPFrame
+	frame.Device = 255
+	frame.Function = 43
+	var req Request
+	req.frame = &frame
+
+	frame.SetData([]byte{0x0D, 1, 2})
+	expect := []byte{0x0D, 1, 2}
+	got := s.handle(&req).GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	// Other MEI types go to the function 43 handler.
+	frame.SetData([]byte{0x0E, 0x01, 0x00})
+	if exception := GetException(s.handle(&req)); exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+	}
+	frame.SetData([]byte{0x0C})
+	if exception := GetException(s.handle(&req)); exception != IllegalDataValue {
+		t.Errorf("expected IllegalDataValue, got %v", exception.String())
+	}
+
+	// A MEI handler takes precedence over the function 43 handler.
+	s.RegisterMEIHandler(0x0E, func(ctx context.Context, frame Framer) ([]byte, *Exception) {
+		return []byte{}, &SlaveDeviceBusy
+	})
+	frame.SetData([]byte{0x0E, 0x01, 0x00})
+	if exception := GetException(s.handle(&req)); exception != SlaveDeviceBusy {
+		t.Errorf("expected SlaveDeviceBusy, got %v", exception.String())
+	}
+	s.RegisterMEIHandler(0x0E, nil)
+	if exception := GetException(s.handle(&req)); exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+	}
+}
+
+func TestEnableDefaults(t *testing.T) {
+	s := NewServer()
+	s.RegisterFunctionHandler(3, ReadHoldingRegisters)
+
+	var frame TCPFrame
+	frame.Device = 255
+	frame.Function = 3
+	SetDataWithRegisterAndNumber(&frame, 0, 1)
+	var req Request
+	req.frame = &frame
+
+	// Without memory, requests are out of range rather than panicking.
+	if exception := GetException(s.handle(&req)); exception != IllegalDataAddress {
+		t.Errorf("expected IllegalDataAddress, got %v", exception.String())
+	}
+
+	// Registered handlers are kept.
+	s.RegisterFunctionHandler(4, ReadExceptionStatus)
+	s.EnableDefaults()
+	if exception := GetException(s.handle(&req)); exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+	}
+	if len(s.Coils) != 65536 {
+		t.Errorf("expected %v, got %v", 65536, len(s.Coils))
+	}
+	frame.Function = 4
+	expect := []byte{0}
+	got := s.handle(&req).GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	// Allocated memory is kept.
+	s.AllocateMemory(1, 1, 1, 1)
+	s.EnableDefaults()
+	if len(s.Coils) != 1 {
+		t.Errorf("expected %v, got %v", 1, len(s.Coils))
+	}
+}
+
 func TestModbus(t *testing.T) {
 	// Server
-	s := NewServer()
+	s := NewServerWithDefaults()
 	err := s.ListenTCP("127.0.0.1:3333")
 	if err != nil {
 		t.Fatalf("failed to listen, got %v\n", err)
@@ -136,3 +448,1117 @@ func TestModbus(t *testing.T) {
 		t.Errorf("expected %v, got %v", expect, got)
 	}
 }
+
+func TestReadOnly(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.ReadOnly = true
+
+	var frame TCPFrame
+	frame.TransactionIdentifier = 1
+	frame.Device = 255
+
+	var req Request
+	req.frame = &frame
+
+	// Writes must be rejected before reaching the handler.
+	for _, function := range []uint8{5, 6, 15, 16} {
+		frame.Function = function
+		SetDataWithRegisterAndNumberAndValues(&frame, 1, 1, []uint16{0xFF00})
+
+		response := s.handle(&req)
+		exception := GetException(response)
+		if exception != IllegalFunction {
+			t.Errorf("function %d: expected IllegalFunction, got %v", function, exception.String())
+		}
+
+		expect := []byte{0, 1, 0, 0, 0, 3, 255, function | 0x80, byte(IllegalFunction)}
+		got := response.Bytes()
+		if !isEqual(expect, got) {
+			t.Errorf("function %d: expected %v, got %v", function, expect, got)
+		}
+	}
+
+	if s.Coils[1] != 0 || s.HoldingRegisters[1] != 0 {
+		t.Errorf("expected memory to be unchanged, got coil %v, register %v", s.Coils[1], s.HoldingRegisters[1])
+	}
+
+	// Custom handlers for write codes are rejected as well.
+	s.RegisterFunctionHandler(6, func(*Server, Framer) ([]byte, *Exception) {
+		t.Errorf("expected handler not to be called")
+		return []byte{}, &Success
+	})
+	frame.Function = 6
+	response := s.handle(&req)
+	if exception := GetException(response); exception != IllegalFunction {
+		t.Errorf("expected IllegalFunction, got %v", exception.String())
+	}
+
+	// Reads still work normally.
+	for _, function := range []uint8{1, 2, 3, 4} {
+		frame.Function = function
+		SetDataWithRegisterAndNumber(&frame, 0, 1)
+
+		response := s.handle(&req)
+		exception := GetException(response)
+		if exception != Success {
+			t.Errorf("function %d: expected Success, got %v", function, exception.String())
+		}
+	}
+}
+
+func TestModbusUDP(t *testing.T) {
+	// Server
+	s := NewServerWithDefaults()
+	s.HoldingRegisters[1] = 0x0304
+	err := s.ListenUDP("127.0.0.1:3334")
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	// Client
+	conn, err := net.Dial("udp", "127.0.0.1:3334")
+	if err != nil {
+		t.Fatalf("failed to dial, got %v\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	// A datagram shorter than an MBAP header is dropped.
+	if _, err := conn.Write([]byte{0, 1, 0}); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+
+	// Read holding register 1.
+	request := []byte{0, 7, 0, 0, 0, 6, 1, 3, 0, 1, 0, 1}
+	if _, err := conn.Write(request); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+
+	response := make([]byte, 512)
+	n, err := conn.Read(response)
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+
+	expect := []byte{0, 7, 0, 0, 0, 5, 1, 3, 2, 3, 4}
+	got := response[:n]
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
+
+func TestLocking(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	var frame TCPFrame
+	frame.Device = 255
+	frame.Function = 3
+	SetDataWithRegisterAndNumber(&frame, 0, 10)
+
+	var req Request
+	req.frame = &frame
+
+	// Application writes and Modbus reads share the server lock.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.Lock()
+			s.HoldingRegisters[5] = uint16(i)
+			s.Unlock()
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		response := s.handle(&req)
+		if exception := GetException(response); exception != Success {
+			t.Fatalf("expected Success, got %v", exception.String())
+		}
+	}
+	<-done
+}
+
+func TestMaxConnections(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.MaxConnections = 1
+	err := s.ListenTCP("127.0.0.1:3335")
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	request := []byte{0, 1, 0, 0, 0, 6, 255, 3, 0, 0, 0, 1}
+	response := make([]byte, 512)
+
+	first, err := net.Dial("tcp", "127.0.0.1:3335")
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	first.SetDeadline(time.Now().Add(time.Second))
+	first.Write(request)
+	if _, err := first.Read(response); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+
+	// The connection beyond the limit is closed.
+	second, err := net.Dial("tcp", "127.0.0.1:3335")
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer second.Close()
+	second.SetDeadline(time.Now().Add(time.Second))
+	second.Write(request)
+	if _, err := second.Read(response); err == nil {
+		t.Errorf("expected error not nil, got %v\n", err)
+	}
+
+	// Closing a connection frees its slot.
+	first.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	third, err := net.Dial("tcp", "127.0.0.1:3335")
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer third.Close()
+	third.SetDeadline(time.Now().Add(time.Second))
+	third.Write(request)
+	if _, err := third.Read(response); err != nil {
+		t.Errorf("expected nil, got %v\n", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.IdleTimeout = 20 * time.Millisecond
+	err := s.ListenTCP("127.0.0.1:3336")
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:3336")
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	// The idle connection is closed by the server.
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 512)); err == nil {
+		t.Errorf("expected error not nil, got %v\n", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("expected the server to close the connection, waited %v", elapsed)
+	}
+}
+
+// chanLogger sends each log message to the channel.
+type chanLogger chan string
+
+func (l chanLogger) Printf(format string, v ...interface{}) {
+	l <- fmt.Sprintf(format, v...)
+}
+
+func TestLogger(t *testing.T) {
+	logger := make(chanLogger, 8)
+
+	s := NewServerWithDefaults()
+	s.Logger = logger
+	err := s.ListenTCP("127.0.0.1:3337")
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:3337")
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+
+	// Send a header without a function code.
+	conn.Write([]byte{0, 1, 0, 0, 0, 1, 255})
+
+	select {
+	case message := <-logger:
+		if !strings.Contains(message, "bad packet") {
+			t.Errorf("expected bad packet message, got %q", message)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("timed out waiting for log message")
+	}
+}
+
+func TestBadFrameResync(t *testing.T) {
+	badFrames := make(chan []byte, 1)
+	s := NewServerWithDefaults()
+	s.Logger = make(chanLogger, 8)
+	s.OnBadFrame = func(raw []byte, err error) {
+		badFrames <- raw
+	}
+	s.HoldingRegisters[1] = 0x0304
+	err := s.ListenTCP("127.0.0.1:3349")
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:3349")
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	// A header without a function code, followed by a good request.
+	bad := []byte{0, 1, 0, 0, 0, 1, 255}
+	conn.Write(append(append([]byte{}, bad...), 0, 2, 0, 0, 0, 6, 255, 3, 0, 1, 0, 1))
+
+	select {
+	case raw := <-badFrames:
+		if !isEqual(bad, raw) {
+			t.Errorf("expected %v, got %v", bad, raw)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for bad frame")
+	}
+
+	// The connection is still in sync.
+	expect := []byte{0, 2, 0, 0, 0, 5, 255, 3, 2, 3, 4}
+	got := make([]byte, len(expect))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
+
+func TestResyncOnBadFrame(t *testing.T) {
+	badFrames := make(chan []byte, 1)
+	s := NewServerWithDefaults()
+	s.Logger = make(chanLogger, 8)
+	s.ResyncOnBadFrame = true
+	s.OnBadFrame = func(raw []byte, err error) {
+		badFrames <- raw
+	}
+	s.HoldingRegisters[1] = 0x0304
+	err := s.ListenTCP("127.0.0.1:3352")
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:3352")
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	// Garbage with a bad protocol identifier, followed by a good request.
+	bad := []byte{0xAA, 0xBB, 0xCC}
+	conn.Write(append(append([]byte{}, bad...), 0, 2, 0, 0, 0, 6, 255, 3, 0, 1, 0, 1))
+
+	select {
+	case raw := <-badFrames:
+		if !isEqual(bad, raw) {
+			t.Errorf("expected %v, got %v", bad, raw)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for bad frame")
+	}
+
+	expect := []byte{0, 2, 0, 0, 0, 5, 255, 3, 2, 3, 4}
+	got := make([]byte, len(expect))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
+
+func TestTCPFrameTooLong(t *testing.T) {
+	badFrames := make(chan []byte, 1)
+	s := NewServerWithDefaults()
+	s.Logger = make(chanLogger, 8)
+	s.OnBadFrame = func(raw []byte, err error) {
+		badFrames <- raw
+	}
+
+	server, client := net.Pipe()
+	go s.ServeConn(server)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(time.Second))
+
+	// The declared length is not allocated or waited for.
+	header := []byte{0, 1, 0, 0, 0xFF, 0xFF, 255}
+	client.Write(header)
+	select {
+	case raw := <-badFrames:
+		if !isEqual(header, raw) {
+			t.Errorf("expected %v, got %v", header, raw)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for bad frame")
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	if _, err := readTCPPacket(bytes.NewReader(header)); err != errTCPFrameTooLong {
+		t.Errorf("expected %v, got %v", errTCPFrameTooLong, err)
+	}
+}
+
+func TestDebug(t *testing.T) {
+	logger := make(chanLogger, 8)
+	s := NewServerWithDefaults()
+	s.Logger = logger
+	s.Debug = true
+	s.HoldingRegisters[1] = 0x0304
+
+	frame := &TCPFrame{TransactionIdentifier: 7, Device: 255, Function: 3}
+	SetDataWithRegisterAndNumber(frame, 1, 1)
+
+	port, w := newPipePort()
+	defer w.Close()
+	s.requestChan <- &Request{conn: port, frame: frame}
+	port.response(t)
+
+	for _, expect := range []string{
+		"request transaction 7 unit 255 function 3: 00 07 00 00 00 06 ff 03 00 01 00 01\n",
+		"response transaction 7 unit 255 function 3: 00 07 00 00 00 05 ff 03 02 03 04\n",
+	} {
+		if got := <-logger; got != expect {
+			t.Errorf("expected %q, got %q", expect, got)
+		}
+	}
+}
+
+func TestTCPFraming(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.HoldingRegisters[1] = 0x0304
+	err := s.ListenTCP("127.0.0.1:3338")
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:3338")
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	request := []byte{0, 1, 0, 0, 0, 6, 255, 3, 0, 1, 0, 1}
+	expect := []byte{0, 1, 0, 0, 0, 5, 255, 3, 2, 3, 4}
+
+	// A frame split across writes.
+	conn.Write(request[:5])
+	time.Sleep(10 * time.Millisecond)
+	conn.Write(request[5:])
+
+	// Two frames in a single write.
+	conn.Write(append(append([]byte{}, request...), request...))
+
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 3; i++ {
+		got := make([]byte, len(expect))
+		if _, err := io.ReadFull(reader, got); err != nil {
+			t.Fatalf("expected nil, got %v\n", err)
+		}
+		if !isEqual(expect, got) {
+			t.Errorf("expected %v, got %v", expect, got)
+		}
+	}
+}
+
+func TestRequestsPerSecond(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.RequestsPerSecond = 1
+	s.HoldingRegisters[1] = 0x0304
+	err := s.ListenTCP("127.0.0.1:3346")
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:3346")
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	request := []byte{0, 1, 0, 0, 0, 6, 255, 3, 0, 1, 0, 1}
+	conn.Write(append(append([]byte{}, request...), request...))
+
+	reader := bufio.NewReader(conn)
+	for _, expect := range [][]byte{
+		{0, 1, 0, 0, 0, 5, 255, 3, 2, 3, 4},
+		// The second request exceeds the rate.
+		{0, 1, 0, 0, 0, 3, 255, 0x83, byte(SlaveDeviceBusy)},
+	} {
+		got := make([]byte, len(expect))
+		if _, err := io.ReadFull(reader, got); err != nil {
+			t.Fatalf("expected nil, got %v\n", err)
+		}
+		if !isEqual(expect, got) {
+			t.Errorf("expected %v, got %v", expect, got)
+		}
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.Workers = 2
+	s.HoldingRegisters[1] = 0x0304
+	release := make(chan struct{})
+	s.RegisterFunctionHandler(100, func(s *Server, frame Framer) ([]byte, *Exception) {
+		<-release
+		return []byte{1}, &Success
+	})
+	err := s.ListenTCP("127.0.0.1:3347")
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+	defer close(release)
+
+	slow, err := net.Dial("tcp", "127.0.0.1:3347")
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer slow.Close()
+	slow.Write([]byte{0, 1, 0, 0, 0, 2, 255, 100})
+
+	conn, err := net.Dial("tcp", "127.0.0.1:3347")
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	// The read is answered while the slow handler is blocked.
+	conn.Write([]byte{0, 1, 0, 0, 0, 6, 255, 3, 0, 1, 0, 1})
+	expect := []byte{0, 1, 0, 0, 0, 5, 255, 3, 2, 3, 4}
+	got := make([]byte, len(expect))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
+
+func TestWorkersServeConn(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.Workers = 2
+	s.HoldingRegisters[1] = 0x0304
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s.RegisterFunctionHandler(100, func(s *Server, frame Framer) ([]byte, *Exception) {
+		close(started)
+		<-release
+		return []byte{1}, &Success
+	})
+	defer close(release)
+
+	slowServer, slow := net.Pipe()
+	defer slow.Close()
+	go s.ServeConn(slowServer)
+	slow.Write([]byte{0, 1, 0, 0, 0, 2, 255, 100})
+	<-started
+
+	server, conn := net.Pipe()
+	defer conn.Close()
+	go s.ServeConn(server)
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	// The read is answered while the slow handler is blocked.
+	conn.Write([]byte{0, 1, 0, 0, 0, 6, 255, 3, 0, 1, 0, 1})
+	expect := []byte{0, 1, 0, 0, 0, 5, 255, 3, 2, 3, 4}
+	got := make([]byte, len(expect))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.RegisterFunctionHandler(100, func(s *Server, frame Framer) ([]byte, *Exception) {
+		time.Sleep(50 * time.Millisecond)
+		return []byte{1}, &Success
+	})
+	err := s.ListenTCP("127.0.0.1:3344")
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:3344")
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	// Start a slow request.
+	conn.Write([]byte{0, 1, 0, 0, 0, 3, 255, 100, 0})
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+
+	// The in-flight response was written before the connection was closed.
+	reader := bufio.NewReader(conn)
+	expect := []byte{0, 1, 0, 0, 0, 3, 255, 100, 1}
+	got := make([]byte, len(expect))
+	if _, err := io.ReadFull(reader, got); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("expected EOF, got %v\n", err)
+	}
+
+	// The server no longer accepts connections.
+	if _, err := net.Dial("tcp", "127.0.0.1:3344"); err == nil {
+		t.Errorf("expected error not nil, got %v\n", err)
+	}
+}
+
+func TestShutdownContextHandler(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.RegisterContextFunctionHandler(100, func(ctx context.Context, frame Framer) ([]byte, *Exception) {
+		select {
+		case <-ctx.Done():
+			return []byte{}, &SlaveDeviceFailure
+		case <-time.After(100 * time.Millisecond):
+			return []byte{1}, &Success
+		}
+	})
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.ServeConn(server)
+	client.SetDeadline(time.Now().Add(time.Second))
+
+	// Start a slow request.
+	client.Write([]byte{0, 1, 0, 0, 0, 2, 255, 100})
+	time.Sleep(10 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		shutdown <- s.Shutdown(ctx)
+	}()
+
+	// The in-flight request is drained rather than cancelled.
+	expect := []byte{0, 1, 0, 0, 0, 3, 255, 100, 1}
+	got := make([]byte, len(expect))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("expected nil, got %v\n", err)
+	}
+}
+
+func TestIdleTimeoutContextHandler(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.IdleTimeout = 20 * time.Millisecond
+	s.RegisterContextFunctionHandler(100, func(ctx context.Context, frame Framer) ([]byte, *Exception) {
+		select {
+		case <-ctx.Done():
+			return []byte{}, &SlaveDeviceFailure
+		case <-time.After(100 * time.Millisecond):
+			return []byte{1}, &Success
+		}
+	})
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.ServeConn(server)
+	client.SetDeadline(time.Now().Add(time.Second))
+
+	// The connection times out while the request is handled, which is not
+	// cancelled.
+	client.Write([]byte{0, 1, 0, 0, 0, 2, 255, 100})
+	expect := []byte{0, 1, 0, 0, 0, 3, 255, 100, 1}
+	got := make([]byte, len(expect))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.RegisterFunctionHandler(100, func(s *Server, frame Framer) ([]byte, *Exception) {
+		time.Sleep(200 * time.Millisecond)
+		return []byte{1}, &Success
+	})
+	err := s.ListenTCP("127.0.0.1:3345")
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:3345")
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte{0, 1, 0, 0, 0, 3, 255, 100, 0})
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v\n", context.DeadlineExceeded, err)
+	}
+}
+
+func TestSuccessConvention(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.RegisterFunctionHandler(100, func(s *Server, frame Framer) ([]byte, *Exception) {
+		return []byte{1}, nil
+	})
+	s.RegisterFunctionHandler(101, func(s *Server, frame Framer) ([]byte, *Exception) {
+		success := Success
+		return []byte{1}, &success
+	})
+
+	var frame TCPFrame
+	frame.Device = 255
+	frame.Data = []byte{0}
+
+	var req Request
+	req.frame = &frame
+
+	for _, function := range []uint8{100, 101} {
+		frame.Function = function
+		response := s.handle(&req)
+		if exception := GetException(response); exception != Success {
+			t.Errorf("function %d: expected Success, got %v", function, exception.String())
+		}
+		if !isEqual([]byte{1}, response.GetData()) {
+			t.Errorf("function %d: expected %v, got %v", function, []byte{1}, response.GetData())
+		}
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	logger := make(chanLogger, 8)
+	s := NewServerWithDefaults()
+	s.Logger = logger
+	s.RegisterFunctionHandler(100, func(s *Server, frame Framer) ([]byte, *Exception) {
+		s.Lock()
+		defer s.Unlock()
+		panic("broken handler")
+	})
+	s.RegisterContextFunctionHandler(101, func(ctx context.Context, frame Framer) ([]byte, *Exception) {
+		panic("broken handler")
+	})
+
+	var frame TCPFrame
+	frame.Device = 255
+	frame.Data = []byte{0}
+
+	var req Request
+	req.frame = &frame
+
+	for _, function := range []uint8{100, 101} {
+		frame.Function = function
+		if exception := GetException(s.handle(&req)); exception != SlaveDeviceFailure {
+			t.Errorf("function %d: expected SlaveDeviceFailure, got %v", function, exception.String())
+		}
+		if message := <-logger; !strings.Contains(message, "broken handler") || !strings.Contains(message, "goroutine") {
+			t.Errorf("expected the panic and a stack trace, got %q", message)
+		}
+	}
+
+	// The server keeps serving.
+	frame.Function = 3
+	SetDataWithRegisterAndNumber(&frame, 0, 1)
+	if exception := GetException(s.handle(&req)); exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+	}
+}
+
+func TestUnitIDs(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.UnitIDs = []uint8{1, 2}
+
+	var frame TCPFrame
+	frame.Function = 3
+	SetDataWithRegisterAndNumber(&frame, 0, 1)
+
+	var req Request
+	req.frame = &frame
+
+	for _, unitID := range []uint8{1, 2} {
+		frame.Device = unitID
+		response := s.handle(&req)
+		if response == nil {
+			t.Fatalf("unit %d: expected a response", unitID)
+		}
+		if exception := GetException(response); exception != Success {
+			t.Errorf("unit %d: expected Success, got %v", unitID, exception.String())
+		}
+	}
+
+	// Other unit IDs are dropped.
+	frame.Device = 3
+	if response := s.handle(&req); response != nil {
+		t.Errorf("expected no response, got %v", response.Bytes())
+	}
+
+	// Or answered with an exception.
+	s.UnitIDException = &GatewayPathUnavailable
+	response := s.handle(&req)
+	if response == nil {
+		t.Fatalf("expected a response")
+	}
+	if exception := GetException(response); exception != GatewayPathUnavailable {
+		t.Errorf("expected GatewayPathUnavailable, got %v", exception.String())
+	}
+}
+
+func TestAddUnit(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.HoldingRegisters[0] = 1
+	unit := s.AddUnit(2)
+	unit.HoldingRegisters[0] = 2
+
+	var frame TCPFrame
+	frame.Function = 3
+	SetDataWithRegisterAndNumber(&frame, 0, 1)
+
+	var req Request
+	req.frame = &frame
+
+	for _, test := range []struct {
+		unitID uint8
+		value  byte
+	}{
+		{1, 1},
+		{2, 2},
+		{3, 1},
+	} {
+		frame.Device = test.unitID
+		response := s.handle(&req)
+		expect := []byte{2, 0, test.value}
+		if !isEqual(expect, response.GetData()) {
+			t.Errorf("unit %d: expected %v, got %v", test.unitID, expect, response.GetData())
+		}
+	}
+
+	// Writes go to the unit's bank.
+	frame.Device = 2
+	frame.Function = 6
+	SetDataWithRegisterAndNumber(&frame, 1, 7)
+	s.handle(&req)
+	if unit.HoldingRegisters[1] != 7 || s.HoldingRegisters[1] != 0 {
+		t.Errorf("expected 7 and 0, got %v and %v", unit.HoldingRegisters[1], s.HoldingRegisters[1])
+	}
+}
+
+func TestHooks(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	var calls []string
+	s.OnRequest = []RequestHook{
+		func(ctx context.Context, frame Framer) *Exception {
+			calls = append(calls, "request 1")
+			return nil
+		},
+		func(ctx context.Context, frame Framer) *Exception {
+			calls = append(calls, "request 2")
+			if frame.GetFunction() == 6 {
+				return &IllegalFunction
+			}
+			return nil
+		},
+	}
+	s.OnResponse = []ResponseHook{
+		func(ctx context.Context, request, response Framer) {
+			calls = append(calls, fmt.Sprintf("response %v", GetException(response).String()))
+		},
+	}
+
+	var frame TCPFrame
+	frame.Function = 3
+	SetDataWithRegisterAndNumber(&frame, 0, 1)
+
+	var req Request
+	req.frame = &frame
+	s.handle(&req)
+
+	frame.Function = 6
+	SetDataWithRegisterAndNumber(&frame, 0, 1)
+	s.handle(&req)
+	if s.HoldingRegisters[0] != 0 {
+		t.Errorf("expected 0, got %v", s.HoldingRegisters[0])
+	}
+
+	expect := []string{
+		"request 1", "request 2", "response " + Success.String(),
+		"request 1", "request 2", "response " + IllegalFunction.String(),
+	}
+	if strings.Join(expect, ", ") != strings.Join(calls, ", ") {
+		t.Errorf("expected %v, got %v", expect, calls)
+	}
+}
+
+func TestAllocateMemory(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.AllocateMemory(16, 8, 4, 2)
+
+	var frame TCPFrame
+	frame.Device = 255
+	var req Request
+	req.frame = &frame
+
+	for _, test := range []struct {
+		function uint8
+		size     uint16
+	}{
+		{1, 16},
+		{2, 8},
+		{3, 4},
+		{4, 2},
+		{15, 16},
+		{16, 4},
+	} {
+		frame.Function = test.function
+		for _, number := range []uint16{test.size, test.size + 1} {
+			switch test.function {
+			case 15:
+				SetDataWithRegisterAndNumberAndBytes(&frame, 0, number, make([]byte, (number+7)/8))
+			case 16:
+				SetDataWithRegisterAndNumberAndValues(&frame, 0, number, make([]uint16, number))
+			default:
+				SetDataWithRegisterAndNumber(&frame, 0, number)
+			}
+
+			expect := Success
+			if number > test.size {
+				expect = IllegalDataAddress
+			}
+			if exception := GetException(s.handle(&req)); exception != expect {
+				t.Errorf("function %d, %d values: expected %v, got %v", test.function, number, expect.String(), exception.String())
+			}
+		}
+	}
+
+	unit := s.AddUnit(1)
+	if len(unit.Coils) != 16 || len(unit.DiscreteInputs) != 8 || len(unit.HoldingRegisters) != 4 || len(unit.InputRegisters) != 2 {
+		t.Errorf("expected the unit to be sized like the server")
+	}
+}
+
+func TestBusy(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	var frame TCPFrame
+	frame.Device = 255
+	frame.Function = 3
+	SetDataWithRegisterAndNumber(&frame, 0, 1)
+
+	var req Request
+	req.frame = &frame
+
+	s.SetBusy(true)
+	if exception := GetException(s.handle(&req)); exception != SlaveDeviceBusy {
+		t.Errorf("expected SlaveDeviceBusy, got %v", exception.String())
+	}
+	if busy := s.Diagnostics().ServerBusy; busy != 1 {
+		t.Errorf("expected 1, got %v", busy)
+	}
+
+	s.SetBusy(false)
+	if exception := GetException(s.handle(&req)); exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+	}
+}
+
+func TestResponseDelay(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.ResponseDelay = 20 * time.Millisecond
+	s.FunctionDelays = map[uint8]time.Duration{4: 0, 100: 60 * time.Millisecond}
+
+	port, w := newPipePort()
+	defer w.Close()
+
+	for _, test := range []struct {
+		function uint8
+		min, max time.Duration
+	}{
+		{3, 20 * time.Millisecond, 60 * time.Millisecond},
+		{4, 0, 20 * time.Millisecond},
+		// Exception responses are delayed like their function.
+		{100, 60 * time.Millisecond, 200 * time.Millisecond},
+	} {
+		frame := &TCPFrame{Device: 255, Function: test.function}
+		SetDataWithRegisterAndNumber(frame, 0, 1)
+
+		start := time.Now()
+		s.requestChan <- &Request{conn: port, frame: frame}
+		port.response(t)
+		if elapsed := time.Since(start); elapsed < test.min || elapsed > test.max {
+			t.Errorf("function %d: expected a delay between %v and %v, got %v", test.function, test.min, test.max, elapsed)
+		}
+	}
+}
+
+func TestFaultInjector(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.UnitIDs = []uint8{1}
+	s.UnitIDException = &GatewayPathUnavailable
+
+	var faults int
+	s.FaultInjector = func(frame Framer) *Exception {
+		faults++
+		if faults%2 == 0 {
+			return &SlaveDeviceFailure
+		}
+		return nil
+	}
+
+	var frame TCPFrame
+	frame.Device = 1
+	frame.Function = 6
+	SetDataWithRegisterAndNumber(&frame, 0, 7)
+
+	var req Request
+	req.frame = &frame
+
+	for _, expect := range []Exception{Success, SlaveDeviceFailure} {
+		if exception := GetException(s.handle(&req)); exception != expect {
+			t.Errorf("expected %v, got %v", expect.String(), exception.String())
+		}
+	}
+
+	// Requests to other units are filtered before the injector.
+	frame.Device = 2
+	if exception := GetException(s.handle(&req)); exception != GatewayPathUnavailable {
+		t.Errorf("expected GatewayPathUnavailable, got %v", exception.String())
+	}
+	if faults != 2 {
+		t.Errorf("expected 2, got %v", faults)
+	}
+}
+
+func TestAliasInputRegisters(t *testing.T) {
+	s := NewServerWithDefaults()
+	if err := s.AliasInputRegisters(10, 2); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+
+	var frame TCPFrame
+	frame.Device = 255
+	var req Request
+	req.frame = &frame
+
+	frame.Function = 6
+	SetDataWithRegisterAndNumber(&frame, 11, 7)
+	s.handle(&req)
+
+	frame.Function = 4
+	SetDataWithRegisterAndNumber(&frame, 0, 2)
+	expect := []byte{4, 0, 0, 0, 7}
+	if got := s.handle(&req).GetData(); !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	// The alias ends with the view.
+	SetDataWithRegisterAndNumber(&frame, 1, 2)
+	if exception := GetException(s.handle(&req)); exception != IllegalDataAddress {
+		t.Errorf("expected IllegalDataAddress, got %v", exception.String())
+	}
+
+	if err := s.AliasInputRegisters(65535, 2); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	var entries []AccessLogEntry
+	s.AccessLog = func(entry AccessLogEntry) {
+		entries = append(entries, entry)
+	}
+
+	ctx := withRemoteAddr(context.Background(), &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 502})
+	ctx = context.WithValue(ctx, userKey, "operator")
+	ctx = context.WithValue(ctx, roleKey, "write")
+
+	frame := &TCPFrame{Device: 255, Function: 3}
+	SetDataWithRegisterAndNumber(frame, 65535, 2)
+	s.handle(&Request{ctx: ctx, frame: frame})
+
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %v", len(entries))
+	}
+	entry := entries[0]
+	if entry.RemoteAddr != "127.0.0.1" || entry.User != "operator" || entry.Role != "write" {
+		t.Errorf("expected 127.0.0.1, operator and write, got %+v", entry)
+	}
+	if entry.UnitID != 255 || entry.Function != 3 || entry.Exception != IllegalDataAddress {
+		t.Errorf("expected unit 255, function 3 and IllegalDataAddress, got %+v", entry)
+	}
+	if entry.RequestBytes != 12 || entry.ResponseBytes != 9 || entry.Time.IsZero() {
+		t.Errorf("expected 12 and 9 bytes, got %+v", entry)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.Authorize = func(role string, function uint8) bool {
+		return role == "write" || !isWriteFunction(function)
+	}
+
+	for _, test := range []struct {
+		role     string
+		function uint8
+		expect   Exception
+	}{
+		{"write", 6, Success},
+		{"read", 6, IllegalFunction},
+		{"", 6, IllegalFunction},
+		{"read", 3, Success},
+	} {
+		ctx := context.Background()
+		if test.role != "" {
+			ctx = context.WithValue(ctx, roleKey, test.role)
+		}
+		frame := &TCPFrame{Device: 255, Function: test.function}
+		SetDataWithRegisterAndNumber(frame, 0, 1)
+
+		if exception := GetException(s.handle(&Request{ctx: ctx, frame: frame})); exception != test.expect {
+			t.Errorf("role %q, function %d: expected %v, got %v", test.role, test.function, test.expect.String(), exception.String())
+		}
+	}
+}
@@ -3,7 +3,7 @@ package mbserver
 import (
 	"context"
 	"io"
-	"log"
+	"time"
 
 	"github.com/goburrow/serial"
 )
@@ -13,39 +13,120 @@ import (
 func (s *Server) ListenRTU(serialConfig *serial.Config) (err error) {
 	port, err := serial.Open(serialConfig)
 	if err != nil {
-		log.Fatalf("failed to open %s: %v\n", serialConfig.Address, err)
+		s.logf("failed to open %s: %v\n", serialConfig.Address, err)
+		return err
 	}
-	s.ports = append(s.ports, port)
-	go s.acceptSerialRequests(port)
+	if err := s.register(func() { s.addPort(port) }); err != nil {
+		port.Close()
+		return err
+	}
+	s.startWorkers()
+	go s.acceptSerialRequests(port, rtuFrameDelay(serialConfig.BaudRate))
 	return err
 }
 
-func (s *Server) acceptSerialRequests(port serial.Port) {
+// rtuFrameDelay returns the silent interval of 3.5 character times that
+// delimits RTU frames. Above 19200 baud the spec fixes it at 1.75ms.
+func rtuFrameDelay(baudRate int) time.Duration {
+	if baudRate <= 0 {
+		// The serial package defaults to 19200 baud.
+		baudRate = 19200
+	}
+	if baudRate > 19200 {
+		return 1750 * time.Microsecond
+	}
+	// A character is 11 bits on the wire.
+	return time.Duration(3.5 * 11 * float64(time.Second) / float64(baudRate))
+}
+
+func (s *Server) acceptSerialRequests(port serial.Port, frameDelay time.Duration) {
+	defer s.wg.Done()
+
+	chunks := make(chan []byte)
+	go s.readSerial(port, chunks)
+
+	var packet []byte
+
+	for {
+		// Only wait for the silent interval once a frame has started.
+		var silence <-chan time.Time
+		if len(packet) != 0 {
+			silence = time.After(frameDelay)
+		}
+
+		select {
+		case chunk, ok := <-chunks:
+			if !ok {
+				return
+			}
+
+			packet = append(packet, chunk...)
+		case <-silence:
+			raw := packet
+			packet = nil
+			frame, err := NewRTUFrame(raw)
+			if err != nil {
+				s.logf("bad serial frame error %v\n", err)
+				s.badFrame(raw, err)
+				continue
+			}
+
+			request := &Request{ctx: context.Background(), conn: port, frame: frame, serial: true}
+
+			s.enqueue(request)
+		}
+	}
+}
+
+// addPort adds a serial port to the ports closed by Close.
+func (s *Server) addPort(port serial.Port) {
+	s.portsMu.Lock()
+	defer s.portsMu.Unlock()
+
+	s.ports = append(s.ports, port)
+}
+
+// removePort removes a serial port that can no longer be read from the pool
+// and closes it, leaving the other ports serving. It returns false if the
+// port is not in the pool, as after Close.
+func (s *Server) removePort(port serial.Port) bool {
+	s.portsMu.Lock()
+	defer s.portsMu.Unlock()
+
+	for i, p := range s.ports {
+		if p == port {
+			s.ports = append(s.ports[:i], s.ports[i+1:]...)
+			port.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// readSerial sends everything read from the port to chunks, closing chunks
+// when the port can no longer be read.
+func (s *Server) readSerial(port serial.Port, chunks chan<- []byte) {
+	defer close(chunks)
+
 	for {
 		buffer := make([]byte, 512)
 
 		bytesRead, err := port.Read(buffer)
 		if err != nil {
-			if err != io.EOF {
-				log.Printf("serial read error %v\n", err)
+			if err == serial.ErrTimeout {
+				continue
+			}
+			// Ports closed by Close are no longer in the pool and their
+			// errors are not reported.
+			if s.removePort(port) && err != io.EOF {
+				s.logf("serial read error %v\n", err)
+				s.reportError(err)
 			}
 			return
 		}
 
 		if bytesRead != 0 {
-
-			// Set the length of the packet to the number of read bytes.
-			packet := buffer[:bytesRead]
-
-			frame, err := NewRTUFrame(packet)
-			if err != nil {
-				log.Printf("bad serial frame error %v\n", err)
-				return
-			}
-
-			request := &Request{context.Background(), port, frame}
-
-			s.requestChan <- request
+			chunks <- buffer[:bytesRead]
 		}
 	}
 }
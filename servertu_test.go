@@ -0,0 +1,180 @@
+package mbserver
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/goburrow/serial"
+)
+
+// pipePort is an in-memory serial.Port.
+type pipePort struct {
+	*io.PipeReader
+	written chan []byte
+}
+
+func newPipePort() (*pipePort, *io.PipeWriter) {
+	r, w := io.Pipe()
+	return &pipePort{r, make(chan []byte, 8)}, w
+}
+
+func (p *pipePort) Open(*serial.Config) error { return nil }
+
+func (p *pipePort) Write(b []byte) (int, error) {
+	p.written <- append([]byte{}, b...)
+	return len(b), nil
+}
+
+func (p *pipePort) response(t *testing.T) []byte {
+	select {
+	case b := <-p.written:
+		return b
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for response")
+		return nil
+	}
+}
+
+func TestRTUFrameDelay(t *testing.T) {
+	if got := rtuFrameDelay(9600); got < 4*time.Millisecond || got > 4100*time.Microsecond {
+		t.Errorf("expected ~4.01ms at 9600 baud, got %v", got)
+	}
+	if got := rtuFrameDelay(115200); got != 1750*time.Microsecond {
+		t.Errorf("expected 1.75ms above 19200 baud, got %v", got)
+	}
+}
+
+func TestAcceptSerialRequests(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.HoldingRegisters[1] = 0x0304
+	badFrames := make(chan []byte, 1)
+	s.OnBadFrame = func(raw []byte, err error) {
+		badFrames <- raw
+	}
+
+	port, w := newPipePort()
+	defer w.Close()
+
+	s.wg.Add(1)
+	go s.acceptSerialRequests(port, 5*time.Millisecond)
+
+	// Read holding register 1 from slave 1.
+	request := (&RTUFrame{Address: 1, Function: 3, Data: []byte{0, 1, 0, 1}}).Bytes()
+	expect := (&RTUFrame{Address: 1, Function: 3, Data: []byte{2, 3, 4}}).Bytes()
+
+	// A frame split across reads is reassembled.
+	w.Write(request[:3])
+	w.Write(request[3:])
+	if got := port.response(t); !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	// A bad frame is reported and discarded without stopping the listener.
+	bad := []byte{1, 3, 0, 1, 0, 1, 0, 0}
+	w.Write(bad)
+	select {
+	case raw := <-badFrames:
+		if !isEqual(bad, raw) {
+			t.Errorf("expected %v, got %v", bad, raw)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for bad frame")
+	}
+
+	// Frames separated by the silent interval are handled separately.
+	w.Write(request)
+	time.Sleep(20 * time.Millisecond)
+	w.Write(request)
+	for i := 0; i < 2; i++ {
+		if got := port.response(t); !isEqual(expect, got) {
+			t.Errorf("expected %v, got %v", expect, got)
+		}
+	}
+
+	// Requests without data after the function code are 4 bytes long.
+	s.SetExceptionStatus(0x6D)
+	w.Write((&RTUFrame{Address: 1, Function: 7}).Bytes())
+	expect = (&RTUFrame{Address: 1, Function: 7, Data: []byte{0x6D}}).Bytes()
+	if got := port.response(t); !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
+
+func TestSerialPortErrors(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.Logger = make(chanLogger, 8)
+
+	failing, failingW := newPipePort()
+	port, w := newPipePort()
+	defer w.Close()
+
+	for _, p := range []*pipePort{failing, port} {
+		s.addPort(p)
+		s.wg.Add(1)
+		go s.acceptSerialRequests(p, 5*time.Millisecond)
+	}
+
+	// A failing port is reported and removed from the pool.
+	readFailed := errors.New("read failed")
+	failingW.CloseWithError(readFailed)
+	select {
+	case err := <-s.Errors():
+		if err != readFailed {
+			t.Errorf("expected %v, got %v", readFailed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for error")
+	}
+	s.portsMu.Lock()
+	if len(s.ports) != 1 || s.ports[0] != port {
+		t.Errorf("expected only the working port, got %v", s.ports)
+	}
+	s.portsMu.Unlock()
+
+	// The other port keeps serving.
+	request := (&RTUFrame{Address: 1, Function: 3, Data: []byte{0, 1, 0, 1}}).Bytes()
+	w.Write(request)
+	expect := (&RTUFrame{Address: 1, Function: 3, Data: []byte{2, 0, 0}}).Bytes()
+	if got := port.response(t); !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	// Ports closed by Close are not reported.
+	s.Close()
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case err := <-s.Errors():
+		t.Errorf("expected no error, got %v", err)
+	default:
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	port, w := newPipePort()
+	defer w.Close()
+
+	s.wg.Add(1)
+	go s.acceptSerialRequests(port, 5*time.Millisecond)
+
+	// Broadcast writes are processed without a response, broadcast reads are
+	// dropped.
+	w.Write((&RTUFrame{Address: 0, Function: 6, Data: []byte{0, 1, 0, 7}}).Bytes())
+	time.Sleep(20 * time.Millisecond)
+	w.Write((&RTUFrame{Address: 0, Function: 3, Data: []byte{0, 1, 0, 1}}).Bytes())
+	time.Sleep(20 * time.Millisecond)
+
+	// Unit 1 answers, its response is the first one written.
+	w.Write((&RTUFrame{Address: 1, Function: 3, Data: []byte{0, 1, 0, 1}}).Bytes())
+	expect := (&RTUFrame{Address: 1, Function: 3, Data: []byte{2, 0, 7}}).Bytes()
+	if got := port.response(t); !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	if noResponse := s.Diagnostics().ServerNoResponse; noResponse != 2 {
+		t.Errorf("expected 2, got %v", noResponse)
+	}
+}
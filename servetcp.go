@@ -1,19 +1,25 @@
 package mbserver
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/asn1"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 func (s *Server) accept(listen net.Listener) error {
+	defer s.wg.Done()
+
 	for {
 		conn, err := listen.Accept()
 		if err != nil {
@@ -21,119 +27,558 @@ func (s *Server) accept(listen net.Listener) error {
 				return nil
 			}
 
-			log.Printf("Unable to accept connections: %#v\n", err)
+			s.logf("Unable to accept connections: %#v\n", err)
+			s.reportError(err)
 
 			return err
 		}
 
+		s.setKeepAlive(conn)
+
+		if s.MaxConnections > 0 && int(atomic.LoadInt32(&s.connections)) >= s.MaxConnections {
+			s.logf("Rejecting connection from %v: %d connections active\n", conn.RemoteAddr(), s.MaxConnections)
+			conn.Close()
+			continue
+		}
+
+		atomic.AddInt32(&s.connections, 1)
+		s.wg.Add(1)
+
 		go func(conn net.Conn) {
-			defer conn.Close()
+			defer s.wg.Done()
+			defer atomic.AddInt32(&s.connections, -1)
 
 			var (
-				user   string
-				roleID = asn1.ObjectIdentifier([]int{1, 3, 6, 1, 4, 1, 50316, 802, 1})
-				role   []byte
+				user  string
+				role  []byte
+				state *tls.ConnectionState
 			)
 
 			if tlsConn, ok := conn.(*tls.Conn); ok {
+				if s.IdleTimeout > 0 {
+					conn.SetDeadline(time.Now().Add(s.IdleTimeout))
+				}
+
 				// Force TLS handshake so we can access peer certificate(s) before the
 				// first read/write call on the connection.
 				if err := tlsConn.Handshake(); err != nil {
 					if err.Error() != "EOF" {
-						log.Printf("TLS handshake error: %v", err)
+						s.logf("TLS handshake error: %v", err)
 					}
 
+					conn.Close()
 					return
 				}
 
-				certs := tlsConn.ConnectionState().PeerCertificates
+				conn.SetDeadline(time.Time{})
+
+				connState := tlsConn.ConnectionState()
+				state = &connState
 
-				for _, cert := range certs {
-					for _, ext := range cert.Extensions {
-						if ext.Id.Equal(roleID) {
-							user = cert.Subject.CommonName
-							role = ext.Value
+				// Only trust roles in verified client certificates. Depending on
+				// ClientAuth, clients may send no or unverified certificates.
+				if len(state.VerifiedChains) > 0 {
+					for _, cert := range state.PeerCertificates {
+						if certUser, certRole := s.certificateRole(cert); certRole != nil {
+							user = certUser
+							role = certRole
 						}
 					}
 				}
 			}
 
-			for {
-				packet := make([]byte, 512)
+			ctx := withConn(context.Background(), conn)
 
-				n, err := conn.Read(packet)
-				if err != nil {
-					if err != io.EOF {
-						log.Printf("read error %v\n", err)
-					}
+			if state != nil {
+				ctx = context.WithValue(ctx, tlsStateKey, state)
+			}
 
-					return
-				}
+			if role != nil {
+				ctx = context.WithValue(ctx, userKey, user)
+				ctx = context.WithValue(ctx, roleKey, string(role))
+			}
 
-				// Set the length of the packet to the number of read bytes.
-				packet = packet[:n]
+			s.serveConn(ctx, conn)
+		}(conn)
+	}
+}
 
-				frame, err := NewTCPFrame(packet)
-				if err != nil {
-					log.Printf("bad packet error %v\n", err)
-					return
-				}
+// ServeConn handles the Modbus TCP frames read from conn, like a connection
+// accepted by ListenTCP, until conn is closed or fails. It then closes conn,
+// which is closed immediately after Close.
+// For example, a test can serve one end of a net.Pipe and send requests on
+// the other end.
+func (s *Server) ServeConn(conn io.ReadWriteCloser) {
+	if err := s.register(func() {}); err != nil {
+		conn.Close()
+		return
+	}
+	defer s.wg.Done()
 
-				ctx := context.Background()
+	s.startWorkers()
 
-				if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
-					ctx = context.WithValue(ctx, "X-Forwarded-For", host)
-				}
+	ctx := context.Background()
+	if netConn, ok := conn.(net.Conn); ok {
+		ctx = withConn(ctx, netConn)
+	}
 
-				if role != nil {
-					ctx = context.WithValue(ctx, "Modbus-User", user)
-					ctx = context.WithValue(ctx, "Modbus-Role", string(role))
-				}
+	s.serveConn(ctx, conn)
+}
+
+// serveConn sends the requests read from conn to the handler, ctx holds the
+// connection's metadata. The requests' context is cancelled once the client
+// disconnects. On Shutdown or an idle timeout, the requests are drained
+// before their context is cancelled.
+func (s *Server) serveConn(ctx context.Context, conn io.ReadWriteCloser) {
+	// Requests sent to the handler and not yet written back.
+	var pending sync.WaitGroup
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	// disconnected is set once the client closed the connection or it
+	// failed, nobody is left to receive the pending responses.
+	var disconnected bool
+	defer func() {
+		// Cancel before waiting so pending handlers can abort.
+		if disconnected {
+			cancel()
+		}
+		pending.Wait()
+		cancel()
+		conn.Close()
+
+		if s.OnDisconnect != nil {
+			s.OnDisconnect(ctx)
+		}
+	}()
+
+	if s.OnConnect != nil {
+		s.OnConnect(ctx)
+	}
+
+	// Only network connections can be interrupted by Shutdown and time out.
+	netConn, _ := conn.(net.Conn)
+	if netConn != nil {
+		if !s.trackConn(netConn) {
+			return
+		}
+		defer s.untrackConn(netConn)
+	}
+
+	// Buffer reads so multiple frames delivered together are not lost.
+	reader := bufio.NewReader(conn)
 
-				request := &Request{ctx, conn, frame}
+	var limiter *tokenBucket
+	if s.RequestsPerSecond > 0 {
+		limiter = newTokenBucket(s.RequestsPerSecond)
+	}
+
+	for {
+		if netConn != nil && !s.setIdleDeadline(netConn) {
+			return
+		}
+
+		var err error
+		if s.ResyncOnBadFrame {
+			err = s.resyncTCP(reader)
+		}
 
-				s.requestChan <- request
+		var packet []byte
+		if err == nil {
+			packet, err = readTCPPacket(reader)
+		}
+		if err != nil {
+			// An idle client timing out, or Shutdown interrupting the read,
+			// is a normal close.
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return
 			}
-		}(conn)
+			disconnected = true
+
+			if err != io.EOF {
+				s.logf("read error %v\n", err)
+			}
+			// The rest of the oversized frame cannot be skipped safely, so
+			// the connection is closed.
+			if err == errTCPFrameTooLong {
+				s.badFrame(packet, err)
+			}
+
+			return
+		}
+
+		// The MBAP header's length keeps the stream in sync, so a bad frame
+		// is skipped rather than closing the connection.
+		frame, err := NewTCPFrame(packet)
+		if err != nil {
+			s.logf("bad packet error %v\n", err)
+			s.badFrame(packet, err)
+			continue
+		}
+
+		pending.Add(1)
+		request := &Request{ctx: ctx, conn: conn, frame: frame, done: pending.Done}
+		if limiter != nil && !limiter.allow(time.Now()) {
+			request.busy = true
+		}
+
+		s.enqueue(request)
+	}
+}
+
+// trackConn registers an active connection so Shutdown can interrupt its
+// reads. It returns false if the server is shutting down.
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	if s.shuttingDown {
+		return false
+	}
+
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	delete(s.conns, conn)
+}
+
+// Connections returns the remote addresses of the active TCP/IP connections.
+func (s *Server) Connections() []string {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	addrs := make([]string, 0, len(s.conns))
+	for conn := range s.conns {
+		addrs = append(addrs, conn.RemoteAddr().String())
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// CloseConnection closes the active TCP/IP connection from the remote
+// address, as returned by Connections.
+func (s *Server) CloseConnection(remoteAddr string) error {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	for conn := range s.conns {
+		if conn.RemoteAddr().String() == remoteAddr {
+			return conn.Close()
+		}
+	}
+	return fmt.Errorf("no connection from %s", remoteAddr)
+}
+
+// setIdleDeadline sets the read deadline for the next request. It returns
+// false if the server is shutting down.
+func (s *Server) setIdleDeadline(conn net.Conn) bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	if s.shuttingDown {
+		return false
+	}
+
+	if s.IdleTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+	}
+
+	return true
+}
+
+// certificateRole returns the user and role in a client certificate, using
+// RoleExtractor if set.
+func (s *Server) certificateRole(cert *x509.Certificate) (string, []byte) {
+	if s.RoleExtractor != nil {
+		return s.RoleExtractor(cert)
+	}
+
+	roleID := s.RoleOID
+	if roleID == nil {
+		roleID = DefaultRoleOID
+	}
+
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(roleID) {
+			return cert.Subject.CommonName, ext.Value
+		}
 	}
+
+	return "", nil
+}
+
+// maxTCPLength is the largest MBAP header length, the unit identifier and
+// a 253 byte PDU.
+const maxTCPLength = 254
+
+// errTCPFrameTooLong is returned for an MBAP header declaring a frame longer
+// than any legal Modbus frame.
+var errTCPFrameTooLong = fmt.Errorf("TCP Frame error: length exceeds %d bytes", maxTCPLength)
+
+// resyncTCP discards bytes until the reader is at a plausible MBAP header,
+// reporting the discarded bytes as a bad frame.
+func (s *Server) resyncTCP(r *bufio.Reader) error {
+	var discarded []byte
+	defer func() {
+		if len(discarded) > 0 {
+			s.logf("discarded %d bytes to resync\n", len(discarded))
+			s.badFrame(discarded, fmt.Errorf("TCP Frame error: bad MBAP header"))
+		}
+	}()
+
+	for {
+		header, err := r.Peek(7)
+		if err != nil {
+			return err
+		}
+
+		protocol := binary.BigEndian.Uint16(header[2:4])
+		length := binary.BigEndian.Uint16(header[4:6])
+		if protocol == 0 && length >= 2 && length <= maxTCPLength {
+			return nil
+		}
+
+		b, _ := r.ReadByte()
+		discarded = append(discarded, b)
+	}
+}
+
+// readTCPPacket reads a single Modbus TCP frame, using the length in the MBAP
+// header to find the end of the frame.
+func readTCPPacket(r io.Reader) ([]byte, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	// The length counts the unit identifier, which is part of the header.
+	length := int(binary.BigEndian.Uint16(header[4:6]))
+	if length < 2 {
+		return header, nil
+	}
+	if length > maxTCPLength {
+		return header, errTCPFrameTooLong
+	}
+
+	packet := make([]byte, 6+length)
+	copy(packet, header)
+	if _, err := io.ReadFull(r, packet[7:]); err != nil {
+		return nil, err
+	}
+
+	return packet, nil
 }
 
 // ListenTCP starts the Modbus server listening on "address:port".
 func (s *Server) ListenTCP(endpoint string) (err error) {
-	listen, err := net.Listen("tcp", endpoint)
+	_, err = s.ListenTCPAddr(endpoint)
+	return err
+}
+
+// ListenTCPAddr starts the Modbus server listening on "address:port" like
+// ListenTCP, and returns the address it listens on, e.g. the port chosen by
+// the system for an endpoint with port 0.
+func (s *Server) ListenTCPAddr(endpoint string) (net.Addr, error) {
+	listen, err := s.listen(endpoint)
 	if err != nil {
-		log.Printf("Failed to Listen: %v\n", err)
-		return err
+		s.logf("Failed to Listen: %v\n", err)
+		return nil, err
 	}
 
-	s.listeners = append(s.listeners, listen)
+	if err := s.Serve(listen); err != nil {
+		return nil, err
+	}
+	return listen.Addr(), nil
+}
+
+// listen creates a TCP/IP listener with ListenConfig, if set.
+func (s *Server) listen(endpoint string) (net.Listener, error) {
+	if s.ListenConfig != nil {
+		return s.ListenConfig.Listen(context.Background(), "tcp", endpoint)
+	}
+	return net.Listen("tcp", endpoint)
+}
+
+// Serve starts the Modbus server accepting connections on a listener that is
+// already bound, such as one passed on by systemd socket activation. It
+// returns once the server is accepting connections, the listener is closed by
+// Close and Shutdown.
+func (s *Server) Serve(listen net.Listener) error {
+	if err := s.register(func() { s.listeners = append(s.listeners, listen) }); err != nil {
+		listen.Close()
+		return err
+	}
 
+	s.startWorkers()
 	go s.accept(listen)
 
-	return err
+	return nil
 }
 
 // ListenTLS starts the Modbus server listening securely on "address:port",
 // using the key, certificate, and CA certificate at the paths provided.
+//
+// The certificates can be replaced without restarting the server using
+// ReloadTLS.
 func (s *Server) ListenTLS(endpoint, key, crt, ca string) error {
-	config, err := createServerTLSConfig(ca, crt, key)
+	_, err := s.ListenTLSAddr(endpoint, key, crt, ca)
+	return err
+}
+
+// ListenTLSAddr starts the Modbus server listening securely on
+// "address:port" like ListenTLS, and returns the address it listens on, e.g.
+// the port chosen by the system for an endpoint with port 0.
+func (s *Server) ListenTLSAddr(endpoint, key, crt, ca string) (net.Addr, error) {
+	loaded, err := s.loadTLSConfig(key, crt, ca)
 	if err != nil {
-		return fmt.Errorf("creating TLS config: %w", err)
+		return nil, err
 	}
 
-	listen, err := tls.Listen("tcp", endpoint, config)
+	// Each listener has its own configuration and each handshake uses the
+	// latest one loaded by ReloadTLS.
+	holder := new(atomic.Value)
+	holder.Store(loaded)
+	config := &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return holder.Load().(*tls.Config), nil
+		},
+	}
+
+	listen, err := s.listenTLS(endpoint, config)
 	if err != nil {
-		return fmt.Errorf("listening for TLS on %s: %w", endpoint, err)
+		return nil, err
 	}
 
-	s.listeners = append(s.listeners, listen)
+	// The configuration can be reloaded as soon as connections are accepted.
+	addr := listen.Addr().String()
+	s.listenMu.Lock()
+	if s.tlsConfigs == nil {
+		s.tlsConfigs = make(map[string]*atomic.Value)
+	}
+	s.tlsConfigs[addr] = holder
+	s.listenMu.Unlock()
+
+	if err := s.Serve(listen); err != nil {
+		s.listenMu.Lock()
+		delete(s.tlsConfigs, addr)
+		s.listenMu.Unlock()
+		return nil, err
+	}
+	return listen.Addr(), nil
+}
 
-	go s.accept(listen)
+// ReloadTLS replaces the key, certificate, and CA certificate used by new
+// connections to the listener started with ListenTLS or ListenTLSAddr on
+// addr, the address it listens on as returned by ListenTLSAddr, e.g.
+// "[::]:802" for the endpoint ":802". Other listeners and established
+// connections are not affected. On error, the previous certificates remain
+// in use.
+func (s *Server) ReloadTLS(addr, key, crt, ca string) error {
+	s.listenMu.Lock()
+	holder := s.tlsConfigs[addr]
+	s.listenMu.Unlock()
+
+	if holder == nil {
+		return fmt.Errorf("reloading TLS on %s: not listening with ListenTLS", addr)
+	}
 
-	return err
+	config, err := s.loadTLSConfig(key, crt, ca)
+	if err != nil {
+		return err
+	}
+
+	holder.Store(config)
+
+	return nil
+}
+
+// loadTLSConfig loads the configuration used by ListenTLS and ReloadTLS.
+func (s *Server) loadTLSConfig(key, crt, ca string) (*tls.Config, error) {
+	clientAuth := tls.RequireAndVerifyClientCert
+	if s.ClientAuth != nil {
+		clientAuth = *s.ClientAuth
+	}
+
+	config, err := createServerTLSConfig(ca, crt, key, s.CRLFile, clientAuth)
+	if err != nil {
+		return nil, fmt.Errorf("creating TLS config: %w", err)
+	}
+
+	return config, nil
+}
+
+// ListenTLSWithConfig starts the Modbus server listening securely on
+// "address:port" using the TLS configuration provided, which must include at
+// least one certificate or set GetCertificate or GetConfigForClient. The
+// configuration is used as is, ReloadTLS does not apply to it, but a
+// GetConfigForClient function can return a different configuration for each
+// connection.
+func (s *Server) ListenTLSWithConfig(endpoint string, config *tls.Config) error {
+	listen, err := s.listenTLS(endpoint, config)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(listen)
 }
 
-func createServerTLSConfig(ca, crt, key string) (*tls.Config, error) {
+// listenTLS returns a TLS listener on endpoint using the configuration.
+func (s *Server) listenTLS(endpoint string, config *tls.Config) (net.Listener, error) {
+	if config == nil || len(config.Certificates) == 0 &&
+		config.GetCertificate == nil && config.GetConfigForClient == nil {
+		return nil, fmt.Errorf("listening for TLS on %s: no certificates in configuration", endpoint)
+	}
+
+	listen, err := s.listen(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("listening for TLS on %s: %w", endpoint, err)
+	}
+
+	// The TLS listener hides the TCP connections from accept.
+	return tls.NewListener(&keepAliveListener{listen, s}, config), nil
+}
+
+// keepAliveListener applies the server's KeepAlivePeriod to the connections
+// it accepts.
+type keepAliveListener struct {
+	net.Listener
+	s *Server
+}
+
+func (l *keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.s.setKeepAlive(conn)
+	}
+	return conn, err
+}
+
+// setKeepAlive applies KeepAlivePeriod to a TCP connection.
+func (s *Server) setKeepAlive(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok || s.KeepAlivePeriod == 0 {
+		return
+	}
+
+	if s.KeepAlivePeriod < 0 {
+		tcpConn.SetKeepAlive(false)
+		return
+	}
+
+	tcpConn.SetKeepAlive(true)
+	tcpConn.SetKeepAlivePeriod(s.KeepAlivePeriod)
+}
+
+func createServerTLSConfig(ca, crt, key, crl string, clientAuth tls.ClientAuthType) (*tls.Config, error) {
 	caCertPEM, err := ioutil.ReadFile(ca)
 	if err != nil {
 		return nil, fmt.Errorf("reading CA certificate: %w", err)
@@ -152,9 +597,15 @@ func createServerTLSConfig(ca, crt, key string) (*tls.Config, error) {
 
 	config := &tls.Config{
 		Certificates: []tls.Certificate{cert},
-		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientAuth:   clientAuth,
 		ClientCAs:    roots,
 	}
 
+	if crl != "" {
+		if config.VerifyPeerCertificate, err = loadCRL(crl, caCertPEM); err != nil {
+			return nil, err
+		}
+	}
+
 	return config, nil
 }
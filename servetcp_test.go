@@ -0,0 +1,1113 @@
+package mbserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testPKI is a CA with a server certificate and a client certificate
+// carrying a role, with the CA and server files written to dir.
+type testPKI struct {
+	dir    string
+	ca     string
+	crt    string
+	key    string
+	roots  *x509.CertPool
+	client tls.Certificate
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	dir, err := ioutil.TempDir("", "mbserver")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	pki := &testPKI{
+		dir:   dir,
+		ca:    filepath.Join(dir, "ca.pem"),
+		crt:   filepath.Join(dir, "server.pem"),
+		key:   filepath.Join(dir, "server-key.pem"),
+		roots: x509.NewCertPool(),
+	}
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mbserver test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+	pki.caCert, pki.caKey = caCert, caKey
+	pki.roots.AddCert(caCert)
+	writePEM(t, pki.ca, "CERTIFICATE", caDER)
+
+	serverCert := pki.issue(t, caCert, caKey, 2, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	writePEM(t, pki.crt, "CERTIFICATE", serverCert.Certificate[0])
+	keyDER, _ := x509.MarshalECPrivateKey(serverCert.PrivateKey.(*ecdsa.PrivateKey))
+	writePEM(t, pki.key, "EC PRIVATE KEY", keyDER)
+
+	pki.client = pki.issue(t, caCert, caKey, 3, &x509.Certificate{
+		Subject:         pkix.Name{CommonName: "operator"},
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		ExtraExtensions: []pkix.Extension{{Id: DefaultRoleOID, Value: []byte("write")}},
+	})
+
+	return pki
+}
+
+// issue returns a certificate signed by the CA.
+func (pki *testPKI) issue(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, serial int64, template *x509.Certificate) tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template.SerialNumber = big.NewInt(serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// revoke writes a CRL signed by the CA revoking the serial numbers and returns
+// its path.
+func (pki *testPKI) revoke(t *testing.T, serials ...int64) string {
+	var revoked []pkix.RevokedCertificate
+	for _, serial := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now(),
+		})
+	}
+
+	der, err := pki.caCert.CreateCRL(rand.Reader, pki.caKey, revoked, time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	path := filepath.Join(pki.dir, "crl.pem")
+	writePEM(t, path, "X509 CRL", der)
+	return path
+}
+
+func (pki *testPKI) Close() {
+	os.RemoveAll(pki.dir)
+}
+
+// dial connects to the TLS server, presenting the client certificate when
+// withCert is set.
+func (pki *testPKI) dial(addr string, withCert bool) (*tls.Conn, error) {
+	config := &tls.Config{RootCAs: pki.roots}
+	if withCert {
+		config.Certificates = []tls.Certificate{pki.client}
+	}
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	return conn, nil
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+}
+
+// roundTrip sends a read of holding register 0 and returns the response
+// error, if any.
+func roundTrip(conn net.Conn) error {
+	if _, err := conn.Write([]byte{0, 1, 0, 0, 0, 6, 255, 3, 0, 0, 0, 1}); err != nil {
+		return err
+	}
+	_, err := conn.Read(make([]byte, 512))
+	return err
+}
+
+func TestCertificateRole(t *testing.T) {
+	otherOID := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+
+	cert := &x509.Certificate{
+		Subject: pkix.Name{CommonName: "operator"},
+		Extensions: []pkix.Extension{
+			{Id: DefaultRoleOID, Value: []byte("read")},
+			{Id: otherOID, Value: []byte("write")},
+		},
+	}
+
+	s := NewServer()
+
+	user, role := s.certificateRole(cert)
+	if user != "operator" || string(role) != "read" {
+		t.Errorf("expected operator read, got %v %s", user, role)
+	}
+
+	s.RoleOID = otherOID
+	user, role = s.certificateRole(cert)
+	if user != "operator" || string(role) != "write" {
+		t.Errorf("expected operator write, got %v %s", user, role)
+	}
+
+	s.RoleOID = asn1.ObjectIdentifier{1, 2, 3}
+	if _, role = s.certificateRole(cert); role != nil {
+		t.Errorf("expected no role, got %s", role)
+	}
+
+	s.RoleExtractor = func(cert *x509.Certificate) (string, []byte) {
+		return "custom", []byte("admin")
+	}
+	user, role = s.certificateRole(cert)
+	if user != "custom" || string(role) != "admin" {
+		t.Errorf("expected custom admin, got %v %s", user, role)
+	}
+}
+
+func TestListenTLSClientAuth(t *testing.T) {
+	pki := newTestPKI(t)
+	defer pki.Close()
+
+	// Client certificates are required by default.
+	s := NewServerWithDefaults()
+	err := s.ListenTLS("127.0.0.1:3340", pki.key, pki.crt, pki.ca)
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err := pki.dial("127.0.0.1:3340", true)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	if err := roundTrip(conn); err != nil {
+		t.Errorf("expected nil, got %v\n", err)
+	}
+	conn.Close()
+
+	conn, err = pki.dial("127.0.0.1:3340", false)
+	if err == nil {
+		if err := roundTrip(conn); err == nil {
+			t.Errorf("expected error not nil, got %v\n", err)
+		}
+		conn.Close()
+	}
+
+	// Client certificates are optional.
+	s = NewServerWithDefaults()
+	clientAuth := tls.VerifyClientCertIfGiven
+	s.ClientAuth = &clientAuth
+	err = s.ListenTLS("127.0.0.1:3341", pki.key, pki.crt, pki.ca)
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err = pki.dial("127.0.0.1:3341", false)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	if err := roundTrip(conn); err != nil {
+		t.Errorf("expected nil, got %v\n", err)
+	}
+	conn.Close()
+
+	// Client certificates are not requested.
+	s = NewServerWithOptions(WithClientAuth(tls.NoClientCert))
+	err = s.ListenTLS("127.0.0.1:3363", pki.key, pki.crt, pki.ca)
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err = pki.dial("127.0.0.1:3363", false)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	if err := roundTrip(conn); err != nil {
+		t.Errorf("expected nil, got %v\n", err)
+	}
+	conn.Close()
+}
+
+func TestListenTLSWithConfig(t *testing.T) {
+	pki := newTestPKI(t)
+	defer pki.Close()
+
+	cert, err := tls.LoadX509KeyPair(pki.crt, pki.key)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	s := NewServerWithDefaults()
+	err = s.ListenTLSWithConfig("127.0.0.1:3342", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pki.roots,
+	})
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+
+	conn, err := pki.dial("127.0.0.1:3342", true)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	if err := roundTrip(conn); err != nil {
+		t.Errorf("expected nil, got %v\n", err)
+	}
+
+	// Close stops the listener.
+	s.Close()
+	if _, err := pki.dial("127.0.0.1:3342", true); err == nil {
+		t.Errorf("expected error not nil, got %v\n", err)
+	}
+}
+
+func TestReloadTLS(t *testing.T) {
+	first := newTestPKI(t)
+	defer first.Close()
+	second := newTestPKI(t)
+	defer second.Close()
+
+	s := NewServerWithDefaults()
+	err := s.ListenTLS("127.0.0.1:3343", first.key, first.crt, first.ca)
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	established, err := first.dial("127.0.0.1:3343", true)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer established.Close()
+
+	if err := s.ReloadTLS("127.0.0.1:3343", second.key, second.crt, second.ca); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	// New handshakes use the reloaded certificates.
+	if _, err := first.dial("127.0.0.1:3343", true); err == nil {
+		t.Errorf("expected error not nil, got %v\n", err)
+	}
+	conn, err := second.dial("127.0.0.1:3343", true)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	if err := roundTrip(conn); err != nil {
+		t.Errorf("expected nil, got %v\n", err)
+	}
+	conn.Close()
+
+	// Established connections keep working.
+	if err := roundTrip(established); err != nil {
+		t.Errorf("expected nil, got %v\n", err)
+	}
+
+	// A bad reload keeps the previous certificates.
+	if err := s.ReloadTLS("127.0.0.1:3343", first.key, first.crt, filepath.Join(first.dir, "missing.pem")); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+	conn, err = second.dial("127.0.0.1:3343", true)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	if err := roundTrip(conn); err != nil {
+		t.Errorf("expected nil, got %v\n", err)
+	}
+	conn.Close()
+}
+
+func TestReloadTLSListeners(t *testing.T) {
+	first := newTestPKI(t)
+	defer first.Close()
+	second := newTestPKI(t)
+	defer second.Close()
+
+	// Both listeners are on ports chosen by the system.
+	s := NewServerWithDefaults()
+	firstAddr, err := s.ListenTLSAddr("127.0.0.1:0", first.key, first.crt, first.ca)
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+	secondAddr, err := s.ListenTLSAddr("127.0.0.1:0", second.key, second.crt, second.ca)
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	a, b := firstAddr.String(), secondAddr.String()
+
+	// Each listener keeps its own certificates.
+	for _, test := range []struct {
+		pki  *testPKI
+		addr string
+		ok   bool
+	}{
+		{first, a, true},
+		{second, a, false},
+		{first, b, false},
+		{second, b, true},
+	} {
+		conn, err := test.pki.dial(test.addr, true)
+		if err == nil {
+			err = roundTrip(conn)
+			conn.Close()
+		}
+		if test.ok && err != nil {
+			t.Errorf("expected nil connecting to %s, got %v\n", test.addr, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("expected error not nil connecting to %s, got %v\n", test.addr, err)
+		}
+	}
+
+	// Reloading one listener leaves the other unchanged.
+	if err := s.ReloadTLS(b, first.key, first.crt, first.ca); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	for _, addr := range []string{a, b} {
+		conn, err := first.dial(addr, true)
+		if err != nil {
+			t.Fatalf("failed to connect, got %v\n", err)
+		}
+		if err := roundTrip(conn); err != nil {
+			t.Errorf("expected nil, got %v\n", err)
+		}
+		conn.Close()
+	}
+
+	if err := s.ReloadTLS("127.0.0.1:0", first.key, first.crt, first.ca); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+}
+
+func TestCRLFile(t *testing.T) {
+	pki := newTestPKI(t)
+	defer pki.Close()
+
+	// The client certificate, serial 3, is revoked.
+	s := NewServerWithDefaults()
+	s.CRLFile = pki.revoke(t, 3)
+	err := s.ListenTLS("127.0.0.1:3355", pki.key, pki.crt, pki.ca)
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err := pki.dial("127.0.0.1:3355", true)
+	if err == nil {
+		if err := roundTrip(conn); err == nil {
+			t.Errorf("expected error not nil, got %v\n", err)
+		}
+		conn.Close()
+	}
+
+	// Reloading with a CRL not revoking it lets the client back in.
+	s.CRLFile = pki.revoke(t, 4)
+	if err := s.ReloadTLS("127.0.0.1:3355", pki.key, pki.crt, pki.ca); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	conn, err = pki.dial("127.0.0.1:3355", true)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	if err := roundTrip(conn); err != nil {
+		t.Errorf("expected nil, got %v\n", err)
+	}
+	conn.Close()
+
+	// CRLs not signed by the CA are rejected.
+	other := newTestPKI(t)
+	defer other.Close()
+	s.CRLFile = other.revoke(t, 3)
+	if err := s.ReloadTLS("127.0.0.1:3355", pki.key, pki.crt, pki.ca); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+	s.CRLFile = filepath.Join(pki.dir, "missing.pem")
+	if err := s.ReloadTLS("127.0.0.1:3355", pki.key, pki.crt, pki.ca); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+}
+
+func TestListenTCPAddr(t *testing.T) {
+	s := NewServerWithDefaults()
+	addr, err := s.ListenTCPAddr("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	if port := addr.(*net.TCPAddr).Port; port == 0 {
+		t.Errorf("expected a port, got %v", port)
+	}
+
+	conn, err := net.DialTimeout("tcp", addr.String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if err := roundTrip(conn); err != nil {
+		t.Errorf("expected nil, got %v\n", err)
+	}
+}
+
+func TestListenConfig(t *testing.T) {
+	controlled := make(chan string, 2)
+
+	s := NewServerWithDefaults()
+	s.ListenConfig = &net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			controlled <- network
+			return nil
+		},
+	}
+	if err := s.ListenTCP("127.0.0.1:3360"); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	if err := s.ListenUDP("127.0.0.1:3360"); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	for _, expect := range []string{"tcp4", "udp4"} {
+		if got := <-controlled; got != expect {
+			t.Errorf("expected %v, got %v", expect, got)
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:3360", time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if err := roundTrip(conn); err != nil {
+		t.Errorf("expected nil, got %v\n", err)
+	}
+}
+
+func TestKeepAlivePeriod(t *testing.T) {
+	pki := newTestPKI(t)
+	defer pki.Close()
+
+	s := NewServerWithDefaults()
+	s.KeepAlivePeriod = time.Minute
+	if err := s.ListenTCP("127.0.0.1:3356"); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	if err := s.ListenTLS("127.0.0.1:3357", pki.key, pki.crt, pki.ca); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:3356", time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if err := roundTrip(conn); err != nil {
+		t.Errorf("expected nil, got %v\n", err)
+	}
+	conn.Close()
+
+	tlsConn, err := pki.dial("127.0.0.1:3357", true)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	if err := roundTrip(tlsConn); err != nil {
+		t.Errorf("expected nil, got %v\n", err)
+	}
+	tlsConn.Close()
+
+	if err := s.ListenTLSWithConfig("127.0.0.1:3358", &tls.Config{}); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+}
+
+// failingListener fails to accept connections.
+type failingListener struct {
+	net.Listener
+	err error
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	return nil, l.err
+}
+
+func TestErrors(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.Logger = make(chanLogger, 8)
+
+	failing := errors.New("accept failed")
+	s.wg.Add(1)
+	if err := s.accept(&failingListener{err: failing}); err != failing {
+		t.Errorf("expected %v, got %v", failing, err)
+	}
+
+	select {
+	case err := <-s.Errors():
+		if err != failing {
+			t.Errorf("expected %v, got %v", failing, err)
+		}
+	default:
+		t.Fatalf("expected an error")
+	}
+
+	// Closed listeners are not reported.
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen.Close()
+	s.wg.Add(1)
+	if err := s.accept(listen); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+
+	select {
+	case err := <-s.Errors():
+		t.Errorf("expected no error, got %v", err)
+	default:
+	}
+}
+
+func TestConnectionEvents(t *testing.T) {
+	pki := newTestPKI(t)
+	defer pki.Close()
+
+	events := make(chan string, 2)
+	event := func(name string) func(context.Context) {
+		return func(ctx context.Context) {
+			addr, _ := RemoteAddrFromContext(ctx)
+			user, _ := UserFromContext(ctx)
+			role, _ := RoleFromContext(ctx)
+			events <- fmt.Sprintf("%s %v %s %s", name, addr != "", user, role)
+		}
+	}
+
+	s := NewServerWithDefaults()
+	s.OnConnect = event("connect")
+	s.OnDisconnect = event("disconnect")
+	err := s.ListenTLS("127.0.0.1:3348", pki.key, pki.crt, pki.ca)
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err := pki.dial("127.0.0.1:3348", true)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	if err := roundTrip(conn); err != nil {
+		t.Errorf("expected nil, got %v\n", err)
+	}
+	conn.Close()
+
+	for _, expect := range []string{"connect true operator write", "disconnect true operator write"} {
+		select {
+		case got := <-events:
+			if got != expect {
+				t.Errorf("expected %v, got %v", expect, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %v", expect)
+		}
+	}
+}
+
+func TestOnDisconnectAfterResponses(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.IdleTimeout = 20 * time.Millisecond
+	s.RegisterFunctionHandler(100, func(s *Server, frame Framer) ([]byte, *Exception) {
+		time.Sleep(50 * time.Millisecond)
+		return []byte{1}, &Success
+	})
+	disconnected := make(chan error, 1)
+	s.OnDisconnect = func(ctx context.Context) {
+		conn, _ := ConnFromContext(ctx)
+		_, err := conn.Write([]byte{0})
+		disconnected <- err
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.ServeConn(server)
+	client.SetDeadline(time.Now().Add(time.Second))
+
+	// The connection times out while the request is handled.
+	client.Write([]byte{0, 1, 0, 0, 0, 2, 255, 100})
+	expect := []byte{0, 1, 0, 0, 0, 3, 255, 100, 1}
+	got := make([]byte, len(expect))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	// OnDisconnect is called once the connection is closed.
+	select {
+	case err := <-disconnected:
+		if err == nil {
+			t.Errorf("expected error not nil, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for OnDisconnect")
+	}
+}
+
+func TestTLSStateFromContext(t *testing.T) {
+	pki := newTestPKI(t)
+	defer pki.Close()
+
+	states := make(chan *tls.ConnectionState, 2)
+	entries := make(chan AccessLogEntry, 2)
+
+	s := NewServerWithDefaults()
+	s.RegisterContextFunctionHandler(100, func(ctx context.Context, frame Framer) ([]byte, *Exception) {
+		state, _ := TLSStateFromContext(ctx)
+		states <- state
+		return []byte{}, &Success
+	})
+	s.AccessLog = func(entry AccessLogEntry) {
+		entries <- entry
+	}
+	if err := s.ListenTLS("127.0.0.1:3362", pki.key, pki.crt, pki.ca); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err := pki.dial("127.0.0.1:3362", true)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{0, 1, 0, 0, 0, 3, 255, 100, 0}); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+
+	expect := conn.ConnectionState()
+	if state := <-states; state == nil || state.Version != expect.Version || state.CipherSuite != expect.CipherSuite {
+		t.Errorf("expected version %x and cipher suite %x, got %+v", expect.Version, expect.CipherSuite, state)
+	}
+	if entry := <-entries; entry.TLSVersion != expect.Version || entry.CipherSuite != expect.CipherSuite {
+		t.Errorf("expected version %x and cipher suite %x, got %+v", expect.Version, expect.CipherSuite, entry)
+	}
+
+	// Plaintext connections have no TLS state.
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.ServeConn(server)
+	client.Write([]byte{0, 1, 0, 0, 0, 3, 255, 100, 0})
+	if state := <-states; state != nil {
+		t.Errorf("expected nil, got %+v", state)
+	}
+	if entry := <-entries; entry.TLSVersion != 0 || entry.CipherSuite != 0 {
+		t.Errorf("expected no TLS version and cipher suite, got %+v", entry)
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.HoldingRegisters[1] = 0x0304
+
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.ServeConn(server)
+		close(done)
+	}()
+	client.SetDeadline(time.Now().Add(time.Second))
+
+	client.Write([]byte{0, 1, 0, 0, 0, 6, 255, 3, 0, 1, 0, 1})
+	expect := []byte{0, 1, 0, 0, 0, 5, 255, 3, 2, 3, 4}
+	got := make([]byte, len(expect))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	// ServeConn returns once the client closes the connection.
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("timed out waiting for ServeConn to return")
+	}
+}
+
+// emptyReadConn returns no data and no error before each read of the
+// connection, as some proxies do.
+type emptyReadConn struct {
+	net.Conn
+	empty bool
+}
+
+func (c *emptyReadConn) Read(b []byte) (int, error) {
+	if c.empty = !c.empty; c.empty {
+		return 0, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func TestServeConnEmptyReads(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.HoldingRegisters[1] = 0x0304
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.ServeConn(&emptyReadConn{Conn: server})
+	client.SetDeadline(time.Now().Add(time.Second))
+
+	// The request arrives in pieces, each preceded by an empty read.
+	for _, chunk := range [][]byte{{0, 1, 0}, {0, 0, 6, 255}, {3, 0, 1, 0, 1}} {
+		if _, err := client.Write(chunk); err != nil {
+			t.Fatalf("expected nil, got %v\n", err)
+		}
+	}
+	expect := []byte{0, 1, 0, 0, 0, 5, 255, 3, 2, 3, 4}
+	got := make([]byte, len(expect))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
+
+func TestServeConnNoData(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.SetExceptionStatus(0x6D)
+	s.ServerID = []byte("mb")
+	s.SetRunIndicator(true)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.ServeConn(server)
+	client.SetDeadline(time.Now().Add(time.Second))
+
+	// Requests without data after the function code are 8 bytes long.
+	for _, test := range []struct {
+		function uint8
+		expect   []byte
+	}{
+		{7, []byte{0x6D}},
+		{17, []byte{3, 'm', 'b', 0xFF}},
+		{11, []byte{0, 0, 0, 2}},
+		// The log holds the receive and send events of the requests
+		// above, the most recent first.
+		{12, []byte{13, 0, 0, 0, 2, 0, 4, 0x80, 0x40, 0x80, 0x40, 0x80, 0x40, 0x80}},
+	} {
+		request := newRequest(255, test.function, nil)
+		if _, err := client.Write(request.Bytes()); err != nil {
+			t.Fatalf("expected nil, got %v\n", err)
+		}
+		packet, err := readTCPPacket(client)
+		if err != nil {
+			t.Fatalf("expected nil, got %v\n", err)
+		}
+		expect := append([]byte{0, 0, 0, 0, 0, byte(2 + len(test.expect)), 255, test.function}, test.expect...)
+		if !isEqual(expect, packet) {
+			t.Errorf("function %d: expected %v, got %v", test.function, expect, packet)
+		}
+	}
+}
+
+func TestContextCancelledOnDisconnect(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.Logger = make(chanLogger, 8)
+	cancelled := make(chan error, 1)
+	s.RegisterContextFunctionHandler(100, func(ctx context.Context, frame Framer) ([]byte, *Exception) {
+		select {
+		case <-ctx.Done():
+			cancelled <- ctx.Err()
+		case <-time.After(time.Second):
+			cancelled <- nil
+		}
+		return []byte{}, &Success
+	})
+
+	server, client := net.Pipe()
+	go s.ServeConn(server)
+
+	client.Write([]byte{0, 1, 0, 0, 0, 3, 255, 100, 0})
+	client.Close()
+
+	if err := <-cancelled; err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.Logger = make(chanLogger, 8)
+	s.WriteTimeout = 20 * time.Millisecond
+
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		s.ServeConn(server)
+		close(done)
+	}()
+
+	// The client never reads the response.
+	client.Write([]byte{0, 1, 0, 0, 0, 6, 255, 3, 0, 1, 0, 1})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for the connection to be closed")
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected EOF, got %v\n", err)
+	}
+}
+
+func TestCloseConnection(t *testing.T) {
+	s := NewServerWithDefaults()
+	err := s.ListenTCP("127.0.0.1:3351")
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:3351")
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if err := roundTrip(conn); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+
+	addrs := s.Connections()
+	if len(addrs) != 1 || addrs[0] != conn.LocalAddr().String() {
+		t.Fatalf("expected [%v], got %v", conn.LocalAddr(), addrs)
+	}
+
+	if err := s.CloseConnection(addrs[0]); err != nil {
+		t.Errorf("expected nil, got %v\n", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected EOF, got %v\n", err)
+	}
+
+	if err := s.CloseConnection("127.0.0.1:1"); err == nil {
+		t.Errorf("expected error not nil, got %v\n", err)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	s := NewServerWithDefaults()
+	if err := s.ListenTCP("127.0.0.1:3359"); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	s.Close()
+	s.Close()
+
+	// The handler exits once nothing is being served.
+	select {
+	case _, ok := <-s.requestChan:
+		if ok {
+			t.Errorf("expected the request channel to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for the handler to exit")
+	}
+
+	if err := s.ListenTCP("127.0.0.1:3359"); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("expected ErrServerClosed, got %v", err)
+	}
+	if err := s.ListenUDP("127.0.0.1:3359"); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("expected ErrServerClosed, got %v", err)
+	}
+
+	// Rejected listeners are closed.
+	listen, err := net.Listen("tcp", "127.0.0.1:3359")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	listen.Close()
+
+	client, conn := net.Pipe()
+	s.ServeConn(conn)
+	if _, err := client.Write([]byte{0}); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+}
+
+func TestServe(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+
+	s := NewServerWithDefaults()
+	if err := s.Serve(listen); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if err := roundTrip(conn); err != nil {
+		t.Errorf("expected nil, got %v\n", err)
+	}
+}
+
+func TestConcurrentListeners(t *testing.T) {
+	pki := newTestPKI(t)
+	defer pki.Close()
+
+	s := NewServerWithDefaults()
+	s.Workers = 4
+	if err := s.ListenTCP("127.0.0.1:3353"); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	if err := s.ListenTLS("127.0.0.1:3354", pki.key, pki.crt, pki.ca); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	dials := []func() (net.Conn, error){
+		func() (net.Conn, error) { return net.Dial("tcp", "127.0.0.1:3353") },
+		func() (net.Conn, error) { return pki.dial("127.0.0.1:3354", true) },
+	}
+
+	errs := make(chan error, 2*len(dials)+1)
+	for i := 0; i < 2*len(dials); i++ {
+		go func(i int) {
+			conn, err := dials[i%len(dials)]()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			for j := 0; j < 50; j++ {
+				// Write, then read back, a register of the client's own.
+				request := []byte{0, 1, 0, 0, 0, 6, 255, 6, 0, byte(i), 0, byte(j)}
+				if _, err := conn.Write(request); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := io.ReadFull(conn, make([]byte, 12)); err != nil {
+					errs <- err
+					return
+				}
+				if err := roundTrip(conn); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(i)
+	}
+
+	// The application writes the memory while the clients do.
+	go func() {
+		for j := 0; j < 50; j++ {
+			if err := s.SetHoldingRegisters(100, []uint16{uint16(j)}); err != nil {
+				errs <- err
+				return
+			}
+			if _, err := s.GetHoldingRegisters(0, 4); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("expected nil, got %v\n", err)
+		}
+	}
+
+	for i := 0; i < 2*len(dials); i++ {
+		if value, _ := s.GetHoldingRegister(uint16(i)); value != 49 {
+			t.Errorf("register %d: expected %v, got %v", i, 49, value)
+		}
+	}
+}
+
+func TestUnknownFunctionPolicy(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.Logger = make(chanLogger, 8)
+
+	var frame TCPFrame
+	frame.Device = 255
+	frame.Function = 100
+	frame.SetData([]byte{0})
+	req := Request{frame: &frame}
+
+	s.UnknownFunctionPolicy = UnknownFunctionDrop
+	if response := s.handle(&req); response != nil {
+		t.Errorf("expected nil, got %v", response)
+	}
+	if stats := s.Stats(); stats.Requests[100] != 1 || stats.Exceptions[100] != 1 {
+		t.Errorf("expected the dropped request to be counted, got %v", stats.Requests[100])
+	}
+
+	// Known functions are answered as usual.
+	frame.Function = 7
+	if exception := GetException(s.handle(&req)); exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+	}
+
+	s.UnknownFunctionPolicy = UnknownFunctionClose
+	server, client := net.Pipe()
+	go s.ServeConn(server)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(time.Second))
+
+	client.Write([]byte{0, 1, 0, 0, 0, 3, 255, 100, 0})
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
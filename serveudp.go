@@ -0,0 +1,93 @@
+package mbserver
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+)
+
+// udpConn adapts a UDP peer address to the io.ReadWriteCloser carried by a
+// Request, so the response is written back to the datagram's source.
+type udpConn struct {
+	conn net.PacketConn
+	addr net.Addr
+}
+
+// Read is not supported, datagrams are read by the listener.
+func (c *udpConn) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+// Write sends the response to the peer the request came from.
+func (c *udpConn) Write(b []byte) (int, error) {
+	return c.conn.WriteTo(b, c.addr)
+}
+
+// Close is a no-op since the packet connection is shared by all peers.
+func (c *udpConn) Close() error {
+	return nil
+}
+
+func (s *Server) acceptUDP(conn net.PacketConn) {
+	defer s.wg.Done()
+
+	for {
+		packet := make([]byte, 512)
+
+		n, addr, err := conn.ReadFrom(packet)
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				s.logf("udp read error %v\n", err)
+				s.reportError(err)
+			}
+
+			return
+		}
+
+		// Set the length of the packet to the number of read bytes.
+		packet = packet[:n]
+
+		// Drop bad datagrams, there is no connection to tear down.
+		frame, err := NewTCPFrame(packet)
+		if err != nil {
+			s.logf("bad udp packet error %v\n", err)
+			s.badFrame(packet, err)
+			continue
+		}
+
+		ctx := withRemoteAddr(context.Background(), addr)
+
+		request := &Request{ctx: ctx, conn: &udpConn{conn, addr}, frame: frame}
+
+		s.enqueue(request)
+	}
+}
+
+// ListenUDP starts the Modbus server listening for Modbus TCP frames
+// encapsulated in UDP datagrams on "address:port".
+func (s *Server) ListenUDP(endpoint string) error {
+	conn, err := s.listenPacket(endpoint)
+	if err != nil {
+		s.logf("Failed to Listen: %v\n", err)
+		return err
+	}
+
+	if err := s.register(func() { s.packetConns = append(s.packetConns, conn) }); err != nil {
+		conn.Close()
+		return err
+	}
+
+	s.startWorkers()
+	go s.acceptUDP(conn)
+
+	return nil
+}
+
+// listenPacket creates a UDP listener with ListenConfig, if set.
+func (s *Server) listenPacket(endpoint string) (net.PacketConn, error) {
+	if s.ListenConfig != nil {
+		return s.ListenConfig.ListenPacket(context.Background(), "udp", endpoint)
+	}
+	return net.ListenPacket("udp", endpoint)
+}
@@ -0,0 +1,86 @@
+package mbserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// snapshotMagic starts every snapshot, followed by the snapshot version.
+const (
+	snapshotMagic   = "MBSS"
+	snapshotVersion = 1
+)
+
+// Snapshot serializes the server's discrete inputs, coils, holding registers
+// and input registers. The memory banks of units added with AddUnit are not
+// included. The snapshot is independent of the machine's byte order.
+func (s *Server) Snapshot() ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var buf bytes.Buffer
+	buf.WriteString(snapshotMagic)
+	buf.WriteByte(snapshotVersion)
+
+	for _, bits := range [][]byte{s.DiscreteInputs, s.Coils} {
+		binary.Write(&buf, binary.BigEndian, uint32(len(bits)))
+		buf.Write(bits)
+	}
+	for _, registers := range [][]uint16{s.HoldingRegisters, s.InputRegisters} {
+		binary.Write(&buf, binary.BigEndian, uint32(len(registers)))
+		buf.Write(Uint16ToBytes(registers))
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Restore loads a snapshot taken by Snapshot. The snapshot must hold as many
+// of each value as the server has allocated, the server's memory is left
+// unchanged when it does not.
+func (s *Server) Restore(data []byte) error {
+	if len(data) < len(snapshotMagic)+1 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return fmt.Errorf("snapshot error: missing header")
+	}
+	if version := data[len(snapshotMagic)]; version != snapshotVersion {
+		return fmt.Errorf("snapshot error: unsupported version %d", version)
+	}
+	data = data[len(snapshotMagic)+1:]
+
+	s.Lock()
+	defer s.Unlock()
+
+	// Read each section before changing any memory.
+	var sections [4][]byte
+	sizes := [4]int{len(s.DiscreteInputs), len(s.Coils), len(s.HoldingRegisters), len(s.InputRegisters)}
+	names := [4]string{"discrete inputs", "coils", "holding registers", "input registers"}
+	for i := range sections {
+		if len(data) < 4 {
+			return fmt.Errorf("snapshot error: %s truncated", names[i])
+		}
+		count := int(binary.BigEndian.Uint32(data[0:4]))
+		if count != sizes[i] {
+			return fmt.Errorf("snapshot error: %d %s, expected %d", count, names[i], sizes[i])
+		}
+
+		size := count
+		if i >= 2 {
+			size *= 2
+		}
+		if len(data) < 4+size {
+			return fmt.Errorf("snapshot error: %s truncated", names[i])
+		}
+		sections[i] = data[4 : 4+size]
+		data = data[4+size:]
+	}
+	if len(data) != 0 {
+		return fmt.Errorf("snapshot error: %d trailing bytes", len(data))
+	}
+
+	copy(s.DiscreteInputs, sections[0])
+	copy(s.Coils, sections[1])
+	copy(s.HoldingRegisters, BytesToUint16(sections[2]))
+	copy(s.InputRegisters, BytesToUint16(sections[3]))
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package mbserver
+
+import "testing"
+
+func TestSnapshot(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.AllocateMemory(3, 2, 2, 1)
+	s.DiscreteInputs[1] = 1
+	s.Coils[2] = 1
+	s.HoldingRegisters[0] = 0x1234
+	s.InputRegisters[0] = 0xABCD
+
+	snapshot, err := s.Snapshot()
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+
+	expect := []byte{
+		'M', 'B', 'S', 'S', 1,
+		0, 0, 0, 2, 0, 1,
+		0, 0, 0, 3, 0, 0, 1,
+		0, 0, 0, 2, 0x12, 0x34, 0, 0,
+		0, 0, 0, 1, 0xAB, 0xCD,
+	}
+	if !isEqual(expect, snapshot) {
+		t.Errorf("expected %v, got %v", expect, snapshot)
+	}
+
+	r := NewServerWithDefaults()
+	r.AllocateMemory(3, 2, 2, 1)
+	if err := r.Restore(snapshot); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if r.DiscreteInputs[1] != 1 || r.Coils[2] != 1 || r.HoldingRegisters[0] != 0x1234 || r.InputRegisters[0] != 0xABCD {
+		t.Errorf("expected the snapshot to be restored")
+	}
+
+	// Bad snapshots leave the memory unchanged.
+	r.AllocateMemory(3, 2, 3, 1)
+	for _, data := range [][]byte{
+		nil,
+		append([]byte("MBSS\x02"), snapshot[5:]...),
+		snapshot,
+		snapshot[:len(snapshot)-1],
+	} {
+		if err := r.Restore(data); err == nil {
+			t.Errorf("expected an error restoring %v", data)
+		}
+	}
+	if r.Coils[2] != 0 {
+		t.Errorf("expected 0, got %v", r.Coils[2])
+	}
+}
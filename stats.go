@@ -0,0 +1,72 @@
+package mbserver
+
+// Stats is a snapshot of the requests handled and the exceptions returned by
+// the server, indexed by function code.
+type Stats struct {
+	Requests   [256]uint64
+	Exceptions [256]uint64
+	// QueueFull counts the requests received while the request queue was
+	// full.
+	QueueFull uint64
+}
+
+// Stats returns a snapshot of the server's request counters. It is safe to
+// call while the server is handling requests.
+func (s *Server) Stats() Stats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	return s.stats
+}
+
+// Diagnostics returns a snapshot of the counters returned by the Diagnostics
+// function. It is safe to call while the server is handling requests.
+func (s *Server) Diagnostics() DiagnosticCounters {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	return s.diagnostics
+}
+
+// UpdateDiagnostics calls update with the counters returned by the
+// Diagnostics function, so the application can increment or set the
+// counters the server does not maintain. The counters are locked during the
+// call, update must not call the server's other diagnostics or statistics
+// methods.
+func (s *Server) UpdateDiagnostics(update func(counters *DiagnosticCounters)) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	update(&s.diagnostics)
+}
+
+// DiagnosticRegister returns the diagnostic register returned by the
+// Diagnostics function.
+func (s *Server) DiagnosticRegister() uint16 {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	return s.diagnosticRegister
+}
+
+// SetDiagnosticRegister sets the diagnostic register returned by the
+// Diagnostics function. It is safe to call while the server is handling
+// requests.
+func (s *Server) SetDiagnosticRegister(value uint16) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	s.diagnosticRegister = value
+}
+
+// countRequest counts a request for the function and whether it returned an
+// exception.
+func (s *Server) countRequest(function uint8, exception bool) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	s.stats.Requests[function]++
+	if exception {
+		s.stats.Exceptions[function]++
+	}
+}
@@ -0,0 +1,31 @@
+package mbserver
+
+import "testing"
+
+func TestStats(t *testing.T) {
+	s := NewServerWithDefaults()
+
+	var frame TCPFrame
+	frame.Device = 255
+	var req Request
+	req.frame = &frame
+
+	frame.Function = 3
+	SetDataWithRegisterAndNumber(&frame, 0, 1)
+	s.handle(&req)
+	s.handle(&req)
+
+	SetDataWithRegisterAndNumber(&frame, 65535, 2)
+	s.handle(&req)
+
+	frame.Function = 100
+	s.handle(&req)
+
+	stats := s.Stats()
+	if stats.Requests[3] != 3 || stats.Exceptions[3] != 1 {
+		t.Errorf("expected 3 requests and 1 exception, got %v and %v", stats.Requests[3], stats.Exceptions[3])
+	}
+	if stats.Requests[100] != 1 || stats.Exceptions[100] != 1 {
+		t.Errorf("expected 1 request and 1 exception, got %v and %v", stats.Requests[100], stats.Exceptions[100])
+	}
+}
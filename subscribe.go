@@ -0,0 +1,71 @@
+package mbserver
+
+import (
+	"sync"
+	"time"
+)
+
+// subscriberBuffer is the number of write events buffered for a subscriber
+// that is not receiving them, further events are dropped.
+const subscriberBuffer = 64
+
+// WriteEvent is a write to coils or holding registers by a request, as passed
+// to OnWrite.
+type WriteEvent struct {
+	UnitID  uint8
+	Code    uint8
+	Address uint16
+	Values  []uint16
+	Time    time.Time
+}
+
+// Subscribe returns a channel receiving an event for each write by the
+// built-in write functions, and a function ending the subscription and
+// closing the channel. Each subscriber gets its own channel. Events are
+// dropped rather than stalling request handling while a subscriber's buffer
+// is full.
+func (s *Server) Subscribe() (<-chan WriteEvent, func()) {
+	events := make(chan WriteEvent, subscriberBuffer)
+
+	s.subscribersMu.Lock()
+	if s.subscribers == nil {
+		s.subscribers = make(map[chan WriteEvent]struct{})
+	}
+	s.subscribers[events] = struct{}{}
+	s.subscribersMu.Unlock()
+
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			s.subscribersMu.Lock()
+			defer s.subscribersMu.Unlock()
+
+			delete(s.subscribers, events)
+			close(events)
+		})
+	}
+}
+
+// publish sends a write event to the subscribers with room in their buffer.
+func (s *Server) publish(unitID, code uint8, address uint16, values []uint16) {
+	s.subscribersMu.Lock()
+	defer s.subscribersMu.Unlock()
+
+	if len(s.subscribers) == 0 {
+		return
+	}
+
+	event := WriteEvent{
+		UnitID:  unitID,
+		Code:    code,
+		Address: address,
+		Values:  append([]uint16{}, values...),
+		Time:    time.Now(),
+	}
+	for events := range s.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
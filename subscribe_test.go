@@ -0,0 +1,45 @@
+package mbserver
+
+import "testing"
+
+func TestSubscribe(t *testing.T) {
+	s := NewServerWithDefaults()
+	first, unsubscribeFirst := s.Subscribe()
+	second, unsubscribeSecond := s.Subscribe()
+	defer unsubscribeSecond()
+
+	var req Request
+	req.frame = NewWriteMultipleRegistersRequest(1, 4, []uint16{1, 2})
+	s.handle(&req)
+
+	for _, events := range []<-chan WriteEvent{first, second} {
+		event := <-events
+		if event.UnitID != 1 || event.Code != 16 || event.Address != 4 || event.Time.IsZero() {
+			t.Errorf("expected a write of function 16 at 4, got %+v", event)
+		}
+		expect := []uint16{1, 2}
+		if !isEqual(expect, event.Values) {
+			t.Errorf("expected %v, got %v", expect, event.Values)
+		}
+	}
+
+	// Unsubscribing closes the channel, the other subscriber keeps receiving.
+	unsubscribeFirst()
+	unsubscribeFirst()
+	if _, ok := <-first; ok {
+		t.Errorf("expected the channel to be closed")
+	}
+	req.frame = NewWriteSingleCoilRequest(1, 3, true)
+	s.handle(&req)
+	if event := <-second; event.Code != 5 || event.Address != 3 || event.Values[0] != 1 {
+		t.Errorf("expected a write of function 5 at 3, got %+v", event)
+	}
+
+	// Events beyond the buffer are dropped rather than blocking the handler.
+	for i := 0; i < subscriberBuffer+1; i++ {
+		s.handle(&req)
+	}
+	if len(second) != subscriberBuffer {
+		t.Errorf("expected %v, got %v", subscriberBuffer, len(second))
+	}
+}
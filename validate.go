@@ -0,0 +1,165 @@
+package mbserver
+
+import "encoding/binary"
+
+// validators check requests to the built-in functions without handling them.
+var validators = map[uint8]func(bank *MemoryBank, frame Framer) *Exception{
+	1: func(bank *MemoryBank, frame Framer) *Exception {
+		return validateRead(frame, 2000, len(bank.Coils))
+	},
+	2: func(bank *MemoryBank, frame Framer) *Exception {
+		return validateRead(frame, 2000, len(bank.DiscreteInputs))
+	},
+	3: func(bank *MemoryBank, frame Framer) *Exception {
+		return validateRead(frame, 125, len(bank.HoldingRegisters))
+	},
+	4: func(bank *MemoryBank, frame Framer) *Exception {
+		return validateRead(frame, 125, len(bank.InputRegisters))
+	},
+	5:  validateWriteSingleCoil,
+	6:  validateWriteHoldingRegister,
+	15: validateWriteMultipleCoils,
+	16: validateWriteHoldingRegisters,
+	22: validateMaskWriteRegister,
+	23: validateReadWriteMultipleRegisters,
+}
+
+// Validate returns the exception the built-in handler of the frame's
+// function would return, without changing any memory, e.g. to check a write
+// before sending it. Functions 1 to 6, 15, 16, 22 and 23 can be validated,
+// other functions return IllegalFunction, as do writes to a ReadOnly server.
+func (s *Server) Validate(frame Framer) *Exception {
+	function := frame.GetFunction()
+	validate, ok := validators[function]
+	if !ok || s.ReadOnly && isWriteFunction(function) {
+		return &IllegalFunction
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	return validate(s.bank(frame), frame)
+}
+
+// validateRead checks a request of functions 1 to 4 for at most limit values
+// from memory holding size values.
+func validateRead(frame Framer, limit, size int) *Exception {
+	if len(frame.GetData()) != 4 {
+		return &IllegalDataValue
+	}
+
+	_, numRegs, endRegister := registerAddressAndNumber(frame)
+	if numRegs < 1 || numRegs > limit {
+		return &IllegalDataValue
+	}
+	if endRegister > size {
+		return &IllegalDataAddress
+	}
+	return &Success
+}
+
+func validateWriteSingleCoil(bank *MemoryBank, frame Framer) *Exception {
+	if len(frame.GetData()) != 4 {
+		return &IllegalDataValue
+	}
+
+	register, value := registerAddressAndValue(frame)
+	// The value is 0xFF00 for on and 0x0000 for off.
+	if value != 0xFF00 && value != 0x0000 {
+		return &IllegalDataValue
+	}
+	if register >= len(bank.Coils) {
+		return &IllegalDataAddress
+	}
+	return &Success
+}
+
+func validateWriteHoldingRegister(bank *MemoryBank, frame Framer) *Exception {
+	if len(frame.GetData()) != 4 {
+		return &IllegalDataValue
+	}
+
+	register, _ := registerAddressAndValue(frame)
+	if register >= len(bank.HoldingRegisters) {
+		return &IllegalDataAddress
+	}
+	return &Success
+}
+
+func validateWriteMultipleCoils(bank *MemoryBank, frame Framer) *Exception {
+	data := frame.GetData()
+	if len(data) < 5 {
+		return &IllegalDataValue
+	}
+
+	_, numRegs, endRegister := registerAddressAndNumber(frame)
+	if numRegs < 1 || numRegs > 1968 {
+		return &IllegalDataValue
+	}
+	// The byte count must hold exactly the quantity of coils, as must the
+	// data following it.
+	if byteCount := int(data[4]); byteCount != (numRegs+7)/8 || len(data[5:]) != byteCount {
+		return &IllegalDataValue
+	}
+	if endRegister > len(bank.Coils) {
+		return &IllegalDataAddress
+	}
+	return &Success
+}
+
+func validateWriteHoldingRegisters(bank *MemoryBank, frame Framer) *Exception {
+	data := frame.GetData()
+	if len(data) < 5 {
+		return &IllegalDataValue
+	}
+
+	// Malformed quantities and byte counts are bad values, only a write
+	// ending past the memory is a bad address.
+	_, numRegs, endRegister := registerAddressAndNumber(frame)
+	if numRegs < 1 || numRegs > 123 {
+		return &IllegalDataValue
+	}
+	if byteCount := int(data[4]); byteCount != numRegs*2 || len(data[5:]) != byteCount {
+		return &IllegalDataValue
+	}
+	if endRegister > len(bank.HoldingRegisters) {
+		return &IllegalDataAddress
+	}
+	return &Success
+}
+
+func validateMaskWriteRegister(bank *MemoryBank, frame Framer) *Exception {
+	data := frame.GetData()
+	if len(data) != 6 {
+		return &IllegalDataValue
+	}
+
+	register, _ := registerAddressAndValue(frame)
+	if register >= len(bank.HoldingRegisters) {
+		return &IllegalDataAddress
+	}
+	return &Success
+}
+
+func validateReadWriteMultipleRegisters(bank *MemoryBank, frame Framer) *Exception {
+	data := frame.GetData()
+	if len(data) < 9 {
+		return &IllegalDataValue
+	}
+
+	readRegister, readNumRegs, _ := registerAddressAndNumber(frame)
+	writeRegister := int(binary.BigEndian.Uint16(data[4:6]))
+	writeNumRegs := int(binary.BigEndian.Uint16(data[6:8]))
+	byteCount := int(data[8])
+
+	if readNumRegs < 1 || readNumRegs > 125 || writeNumRegs < 1 || writeNumRegs > 121 {
+		return &IllegalDataValue
+	}
+	if byteCount != writeNumRegs*2 || len(data[9:]) != byteCount {
+		return &IllegalDataValue
+	}
+	if readRegister+readNumRegs > len(bank.HoldingRegisters) || writeRegister+writeNumRegs > len(bank.HoldingRegisters) {
+		return &IllegalDataAddress
+	}
+	return &Success
+}
@@ -0,0 +1,42 @@
+package mbserver
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	s := NewServerWithDefaults()
+	s.AllocateMemory(8, 8, 8, 8)
+
+	for _, test := range []struct {
+		frame  Framer
+		expect Exception
+	}{
+		{NewReadHoldingRegistersRequest(1, 0, 8), Success},
+		{NewReadHoldingRegistersRequest(1, 0, 9), IllegalDataAddress},
+		{NewWriteSingleCoilRequest(1, 7, true), Success},
+		{NewWriteSingleCoilRequest(1, 8, true), IllegalDataAddress},
+		{newAddressRequest(1, 5, 0, 1), IllegalDataValue},
+		{NewWriteMultipleCoilsRequest(1, 0, make([]bool, 8)), Success},
+		{NewWriteMultipleRegistersRequest(1, 6, []uint16{1, 2}), Success},
+		{NewWriteMultipleRegistersRequest(1, 7, []uint16{1, 2}), IllegalDataAddress},
+		{NewWriteMultipleRegistersRequest(1, 0, nil), IllegalDataValue},
+		{newRequest(1, 22, []byte{0, 1, 0, 0, 0, 1}), Success},
+		{newRequest(1, 23, []byte{0, 7, 0, 2, 0, 0, 0, 1, 2, 0, 1}), IllegalDataAddress},
+		{newRequest(1, 17, nil), IllegalFunction},
+	} {
+		if exception := s.Validate(test.frame); *exception != test.expect {
+			t.Errorf("%v: expected %v, got %v", test.frame, test.expect.String(), exception.String())
+		}
+	}
+
+	// Nothing is written.
+	for i := range s.HoldingRegisters {
+		if s.HoldingRegisters[i] != 0 || s.Coils[i] != 0 {
+			t.Errorf("expected address %d unchanged", i)
+		}
+	}
+
+	s.ReadOnly = true
+	if exception := s.Validate(NewWriteSingleRegisterRequest(1, 0, 1)); *exception != IllegalFunction {
+		t.Errorf("expected IllegalFunction, got %v", exception.String())
+	}
+}